@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/dmage/deepgrid/pkg/artifacts"
+	"github.com/dmage/deepgrid/pkg/cluster"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+// loadFailureSignatures returns the distinct non-empty signatures of failed
+// and flaky test results that finished after finishedAfter.
+func loadFailureSignatures(ctx context.Context, conn querier, finishedAfter int64) ([]string, error) {
+	rows, err := conn.Query(
+		ctx,
+		`select distinct signature from test_results
+		where status in ($1, $2) and signature <> '' and finished_timestamp > $3
+		order by signature`,
+		artifacts.TestStatusFailure, artifacts.TestStatusFlake, finishedAfter,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var signatures []string
+	for rows.Next() {
+		var signature string
+		err = rows.Scan(&signature)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, signature)
+	}
+	return signatures, rows.Err()
+}
+
+func loadSignatureClusters(ctx context.Context, conn querier) (map[string]int64, error) {
+	rows, err := conn.Query(ctx, "select signature, cluster_id from signature_clusters")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clusters := map[string]int64{}
+	for rows.Next() {
+		var signature string
+		var id int64
+		err = rows.Scan(&signature, &id)
+		if err != nil {
+			return nil, err
+		}
+		clusters[signature] = id
+	}
+	return clusters, rows.Err()
+}
+
+// nextClusterID returns the smallest cluster ID that has never been
+// assigned.
+func nextClusterID(ctx context.Context, conn querier) (int64, error) {
+	var id int64
+	err := conn.QueryRow(
+		ctx,
+		`select greatest(
+			(select coalesce(max(cluster_id), 0) from signature_clusters),
+			(select case when is_called then last_value else 0 end from signature_cluster_ids)
+		) + 1`,
+	).Scan(&id)
+	return id, err
+}
+
+// saveSignatureClusters replaces the clusters of signatures. It should be
+// called within a transaction.
+func saveSignatureClusters(ctx context.Context, tx pgx.Tx, signatures []string, ids []int64) error {
+	_, err := tx.Exec(ctx, "delete from signature_clusters")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.CopyFrom(
+		ctx,
+		pgx.Identifier{"signature_clusters"},
+		[]string{"signature", "cluster_id"},
+		pgx.CopyFromSlice(len(signatures), func(i int) ([]interface{}, error) {
+			return []interface{}{signatures[i], ids[i]}, nil
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	var maxID int64
+	for _, id := range ids {
+		if id > maxID {
+			maxID = id
+		}
+	}
+	if maxID > 0 {
+		_, err = tx.Exec(ctx, "select setval('signature_cluster_ids', greatest($1, (select case when is_called then last_value else 1 end from signature_cluster_ids)))", maxID)
+	}
+	return err
+}
+
+var clusterOpts struct {
+	age       time.Duration
+	threshold float64
+}
+
+func init() {
+	rootCmd.AddCommand(clusterCmd)
+
+	clusterCmd.Flags().DurationVar(&clusterOpts.age, "age", 0, "only cluster signatures of test results that finished within this duration (0 means all)")
+	clusterCmd.Flags().Float64Var(&clusterOpts.threshold, "threshold", 0.7, "minimum Jaccard similarity of the line sets of signatures in a cluster")
+}
+
+var clusterCmd = &cobra.Command{
+	Use:   "cluster",
+	Short: "Group similar signatures into clusters",
+	Long: `Group signatures of failed and flaky test results that share most of their
+lines into clusters.
+
+Clusters keep their IDs between runs as long as they keep any of their
+signatures, so the command can be run periodically.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		if clusterOpts.threshold <= 0 || clusterOpts.threshold > 1 {
+			klog.Exitf("--threshold must be in (0, 1]")
+		}
+
+		conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+		if err != nil {
+			klog.Exitf("Unable to connect to database: %s", err)
+		}
+		defer conn.Close(ctx)
+
+		finishedAfter := int64(0)
+		if clusterOpts.age != 0 {
+			finishedAfter = time.Now().Add(-clusterOpts.age).Unix()
+		}
+
+		startTime := time.Now()
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			klog.Exit(err)
+		}
+		defer tx.Rollback(ctx)
+
+		// Concurrent runs would assign the same new IDs.
+		_, err = tx.Exec(ctx, "lock table signature_clusters in exclusive mode")
+		if err != nil {
+			klog.Exit(err)
+		}
+
+		signatures, err := loadFailureSignatures(ctx, tx, finishedAfter)
+		if err != nil {
+			klog.Exit(err)
+		}
+		previous, err := loadSignatureClusters(ctx, tx)
+		if err != nil {
+			klog.Exit(err)
+		}
+		nextID, err := nextClusterID(ctx, tx)
+		if err != nil {
+			klog.Exit(err)
+		}
+
+		var clusters [][]string
+		for _, members := range cluster.Signatures(signatures, clusterOpts.threshold) {
+			var sigs []string
+			for _, i := range members {
+				sigs = append(sigs, signatures[i])
+			}
+			clusters = append(clusters, sigs)
+		}
+		clusterIDs := cluster.AssignIDs(clusters, previous, nextID)
+
+		var sigs []string
+		var ids []int64
+		for i, c := range clusters {
+			for _, sig := range c {
+				sigs = append(sigs, sig)
+				ids = append(ids, clusterIDs[i])
+			}
+		}
+
+		err = saveSignatureClusters(ctx, tx, sigs, ids)
+		if err != nil {
+			klog.Exit(err)
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			klog.Exit(err)
+		}
+
+		klog.Infof("Grouped %d signatures into %d clusters in %s", len(signatures), len(clusters), time.Since(startTime))
+	},
+}
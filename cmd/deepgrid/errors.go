@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dmage/deepgrid/pkg/artifacts"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+// Stages of indexing a build. They are stored in the index_errors table.
+const (
+	stageUnknown  = "unknown"
+	stageLoad     = "load"
+	stageMeta     = "meta"
+	stageStatus   = "status"
+	stageMetadata = "metadata"
+	stageResults  = "results"
+	stageLogs     = "logs"
+	stageSave     = "save"
+)
+
+// stageError annotates an error with the stage of indexing at which it
+// happened.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("%s: %s", e.stage, e.err)
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+const (
+	minRetryDelay = 5 * time.Minute
+	maxRetryDelay = 24 * time.Hour
+)
+
+type IndexError struct {
+	Job         string
+	BuildID     string
+	Stage       string
+	Error       string
+	Attempts    int
+	LastAttempt int64
+}
+
+// NextAttempt returns the time after which the build should be retried. The
+// delay doubles with every failed attempt.
+func (e *IndexError) NextAttempt() time.Time {
+	delay := minRetryDelay
+	for i := 1; i < e.Attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return time.Unix(e.LastAttempt, 0).Add(delay)
+}
+
+func saveIndexError(ctx context.Context, conn querier, build *artifacts.Build, stage string, message string) error {
+	_, err := conn.Exec(
+		ctx,
+		`insert into index_errors (job, build_id, stage, error, attempts, last_attempt) values ($1, $2, $3, $4, 1, $5)
+		on conflict (job, build_id) do update set stage = excluded.stage, error = excluded.error, attempts = index_errors.attempts + 1, last_attempt = excluded.last_attempt`,
+		build.Job, build.BuildID, stage, message, time.Now().Unix(),
+	)
+	return err
+}
+
+func deleteIndexError(ctx context.Context, conn querier, build *artifacts.Build) error {
+	_, err := conn.Exec(ctx, "delete from index_errors where job = $1 and build_id = $2", build.Job, build.BuildID)
+	return err
+}
+
+// loadIndexErrors returns index errors for jobs that match the regular
+// expression job.
+func loadIndexErrors(ctx context.Context, conn querier, job string) ([]*IndexError, error) {
+	rows, err := conn.Query(
+		ctx,
+		"select job, build_id, stage, error, attempts, last_attempt from index_errors where job ~ $1 order by job, last_attempt",
+		job,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var indexErrors []*IndexError
+	for rows.Next() {
+		e := &IndexError{}
+		err = rows.Scan(&e.Job, &e.BuildID, &e.Stage, &e.Error, &e.Attempts, &e.LastAttempt)
+		if err != nil {
+			return nil, err
+		}
+		indexErrors = append(indexErrors, e)
+	}
+	return indexErrors, rows.Err()
+}
+
+// deleteIndexErrors deletes index errors for jobs that match the regular
+// expression job. If buildID is not empty, only errors for this build are
+// deleted.
+func deleteIndexErrors(ctx context.Context, conn querier, job string, buildID string) error {
+	var err error
+	if buildID == "" {
+		_, err = conn.Exec(ctx, "delete from index_errors where job ~ $1", job)
+	} else {
+		_, err = conn.Exec(ctx, "delete from index_errors where job ~ $1 and build_id = $2", job, buildID)
+	}
+	return err
+}
+
+var errorsOpts struct {
+	job     string
+	buildID string
+}
+
+func init() {
+	rootCmd.AddCommand(errorsCmd)
+	errorsCmd.AddCommand(errorsListCmd)
+	errorsCmd.AddCommand(errorsClearCmd)
+
+	errorsCmd.PersistentFlags().StringVar(&errorsOpts.job, "job", "", "regular expression for job names")
+	errorsClearCmd.Flags().StringVar(&errorsOpts.buildID, "build-id", "", "clear only the error for this build")
+}
+
+var errorsCmd = &cobra.Command{
+	Use:   "errors",
+	Short: "Manage builds that failed to be indexed",
+}
+
+var errorsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List builds that failed to be indexed",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+		if err != nil {
+			klog.Exitf("Unable to connect to database: %s", err)
+		}
+		defer conn.Close(ctx)
+
+		indexErrors, err := loadIndexErrors(ctx, conn, errorsOpts.job)
+		if err != nil {
+			klog.Exit(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "JOB\tBUILD ID\tSTAGE\tATTEMPTS\tLAST ATTEMPT\tNEXT ATTEMPT\tERROR")
+		for _, e := range indexErrors {
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+				e.Job, e.BuildID, e.Stage, e.Attempts,
+				time.Unix(e.LastAttempt, 0).Format(time.RFC3339),
+				e.NextAttempt().Format(time.RFC3339),
+				e.Error,
+			)
+		}
+		w.Flush()
+	},
+}
+
+var errorsClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Clear index errors so that builds are retried immediately",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+		if err != nil {
+			klog.Exitf("Unable to connect to database: %s", err)
+		}
+		defer conn.Close(ctx)
+
+		err = deleteIndexErrors(ctx, conn, errorsOpts.job, errorsOpts.buildID)
+		if err != nil {
+			klog.Exit(err)
+		}
+	},
+}
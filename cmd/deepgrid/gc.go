@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/dmage/deepgrid/pkg/artifacts"
+	"github.com/dmage/deepgrid/pkg/config"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+type gcStats struct {
+	Builds      int64
+	TestResults int64
+	OutputBytes int64
+}
+
+func (s *gcStats) add(o gcStats) {
+	s.Builds += o.Builds
+	s.TestResults += o.TestResults
+	s.OutputBytes += o.OutputBytes
+}
+
+// gcTestGroup enforces the retention policy of testGroup.
+func gcTestGroup(ctx context.Context, conn *pgxpool.Conn, testGroup config.TestGroup) (gcStats, error) {
+	var stats gcStats
+	retention := testGroup.Retention
+	if retention.Days == 0 {
+		return stats, nil
+	}
+	cutoff := time.Now().Add(-time.Duration(retention.Days) * 24 * time.Hour).Unix()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Outputs that are no longer referenced are deleted by gcOutputs.
+	if retention.KeepCounts {
+		tag, err := tx.Exec(
+			ctx,
+			`update test_results set output_hash = null, output_reduced = true, system_out = null, system_err = null
+			where job = $1 and finished_timestamp < $2 and (output_hash is not null or system_out is not null or system_err is not null)`,
+			testGroup.Name, cutoff,
+		)
+		if err != nil {
+			return stats, err
+		}
+		stats.TestResults = tag.RowsAffected()
+		return stats, tx.Commit(ctx)
+	}
+
+	tag, err := tx.Exec(ctx, "delete from test_results where job = $1 and finished_timestamp < $2", testGroup.Name, cutoff)
+	if err != nil {
+		return stats, err
+	}
+	stats.TestResults = tag.RowsAffected()
+
+	_, err = tx.Exec(
+		ctx,
+		"delete from build_artifacts where job = $1 and build_id in (select build_id from build_statuses where job = $1 and finished_timestamp < $2)",
+		testGroup.Name, cutoff,
+	)
+	if err != nil {
+		return stats, err
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		"delete from build_metadata where job = $1 and build_id in (select build_id from build_statuses where job = $1 and finished_timestamp < $2)",
+		testGroup.Name, cutoff,
+	)
+	if err != nil {
+		return stats, err
+	}
+
+	_, err = tx.Exec(ctx, "delete from index_errors where job = $1 and last_attempt < $2", testGroup.Name, cutoff)
+	if err != nil {
+		return stats, err
+	}
+
+	tag, err = tx.Exec(ctx, "delete from build_statuses where job = $1 and finished_timestamp < $2", testGroup.Name, cutoff)
+	if err != nil {
+		return stats, err
+	}
+	stats.Builds = tag.RowsAffected()
+
+	return stats, tx.Commit(ctx)
+}
+
+// gcOutputs deletes outputs that are not referenced by test results. Outputs
+// that are being saved by the indexer are locked and skipped.
+func gcOutputs(ctx context.Context, conn querier) (count int64, bytes int64, err error) {
+	err = conn.QueryRow(
+		ctx,
+		`with orphans as (
+			select hash from outputs o
+			where not exists (select 1 from test_results tr where tr.output_hash = o.hash)
+			for update skip locked
+		), deleted as (
+			delete from outputs where hash in (select hash from orphans) returning octet_length(output) as size
+		)
+		select count(*), coalesce(sum(size), 0) from deleted`,
+	).Scan(&count, &bytes)
+	return count, bytes, err
+}
+
+type gcOptions struct {
+	cacheMaxAge  time.Duration
+	cacheMaxSize int64
+}
+
+// runGC enforces the retention policies of all test groups and prunes the
+// artifact cache.
+func runGC(ctx context.Context, pool *pgxpool.Pool, testGroups []config.TestGroup, opts gcOptions) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	var total gcStats
+	for _, testGroup := range testGroups {
+		stats, err := gcTestGroup(ctx, conn, testGroup)
+		if err != nil {
+			return err
+		}
+		if stats.TestResults != 0 || stats.Builds != 0 {
+			klog.V(2).Infof("Garbage collected %s: %d builds, %d test results", testGroup.Name, stats.Builds, stats.TestResults)
+		}
+		total.add(stats)
+	}
+
+	outputs, outputBytes, err := gcOutputs(ctx, conn)
+	if err != nil {
+		return err
+	}
+	total.OutputBytes += outputBytes
+	klog.Infof("Garbage collected %d builds, %d test results, %d outputs (%d bytes)", total.Builds, total.TestResults, outputs, total.OutputBytes)
+
+	if opts.cacheMaxAge != 0 || opts.cacheMaxSize != 0 {
+		cacheStats, err := artifacts.PruneCache(artifacts.DefaultCacheDir, opts.cacheMaxAge, opts.cacheMaxSize)
+		if err != nil {
+			return err
+		}
+		klog.Infof("Pruned %d files (%d bytes) from the cache, %d files (%d bytes) left", cacheStats.Files, cacheStats.Bytes, cacheStats.RemainingFiles, cacheStats.RemainingBytes)
+	}
+
+	return nil
+}
+
+var gcOpts gcOptions
+
+func addGCFlags(cmd *cobra.Command, opts *gcOptions) {
+	cmd.Flags().DurationVar(&opts.cacheMaxAge, "cache-max-age", 0, "delete cached artifacts that were not used for this duration (0 means no limit)")
+	cmd.Flags().Int64Var(&opts.cacheMaxSize, "cache-max-size", 0, "delete the least recently used cached artifacts until the cache is not bigger than this number of bytes (0 means no limit)")
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+	addGCFlags(gcCmd, &gcOpts)
+}
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete data that is older than the retention policy and prune the artifact cache",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		pool, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+		if err != nil {
+			klog.Exitf("Unable to connect to database: %s", err)
+		}
+		defer pool.Close()
+
+		cfg, err := config.LoadFromFile("./config.yaml")
+		if err != nil {
+			klog.Exit(err)
+		}
+
+		err = runGC(ctx, pool, cfg.TestGroups, gcOpts)
+		if err != nil {
+			klog.Exit(err)
+		}
+	},
+}
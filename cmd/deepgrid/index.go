@@ -2,23 +2,38 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"os"
-	"regexp"
+	"os/signal"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/dmage/deepgrid/pkg/artifacts"
 	"github.com/dmage/deepgrid/pkg/config"
-	"github.com/dmage/deepgrid/pkg/denoise"
+	"github.com/dmage/deepgrid/pkg/redact"
+	"github.com/dmage/deepgrid/pkg/signature"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/spf13/cobra"
 	"google.golang.org/api/option"
 	"k8s.io/klog/v2"
 )
 
-func loadBuildMeta(ctx context.Context, conn *pgx.Conn, build *artifacts.Build) (*artifacts.BuildMeta, error) {
+// querier is the subset of pgx.Conn, pgxpool.Conn and pgx.Tx that is used
+// by the helpers below.
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+func loadBuildMeta(ctx context.Context, conn querier, build *artifacts.Build) (*artifacts.BuildMeta, error) {
 	var filesBuf []byte
 	err := conn.QueryRow(ctx, "select files from build_artifacts where job=$1 and build_id=$2", build.Job, build.BuildID).Scan(&filesBuf)
 	if err != nil {
@@ -32,7 +47,7 @@ func loadBuildMeta(ctx context.Context, conn *pgx.Conn, build *artifacts.Build)
 	return meta, err
 }
 
-func saveBuildMeta(ctx context.Context, conn *pgx.Conn, buildMeta *artifacts.BuildMeta) error {
+func saveBuildMeta(ctx context.Context, conn querier, buildMeta *artifacts.BuildMeta) error {
 	filesBuf, err := json.Marshal(buildMeta.Files)
 	if err != nil {
 		return err
@@ -49,15 +64,47 @@ type DBBuildStatus struct {
 	Result            string
 }
 
-func saveBuildStatus(ctx context.Context, conn *pgx.Conn, build *artifacts.Build, status *artifacts.BuildStatus) error {
+// saveBuildStatus marks build as indexed. redactions is the number of secrets
+// that were removed from the outputs, properties and metadata of the build.
+func saveBuildStatus(ctx context.Context, conn querier, build *artifacts.Build, status *artifacts.BuildStatus, redactions int) error {
+	var repo, baseSHA, headSHA *string
+	var pullNumber *int
+	if status.Pull != nil {
+		repo, pullNumber, baseSHA, headSHA = &status.Pull.Repo, &status.Pull.Number, &status.Pull.BaseSHA, &status.Pull.HeadSHA
+	}
 	_, err := conn.Exec(
-		ctx, "insert into build_statuses (job, build_id, started_timestamp, finished_timestamp, result) values ($1, $2, $3, $4, $5)",
-		build.Job, build.BuildID, status.StartedTimestamp, status.FinishedTimestamp, status.Result,
+		ctx, "insert into build_statuses (job, build_id, started_timestamp, finished_timestamp, result, repo, pull_number, base_sha, head_sha, redactions) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		build.Job, build.BuildID, status.StartedTimestamp, status.FinishedTimestamp, status.Result, repo, pullNumber, baseSHA, headSHA, redactions,
+	)
+	return err
+}
+
+// saveBuildMetadata replaces the metadata of build. It should be called
+// within a transaction.
+func saveBuildMetadata(ctx context.Context, tx pgx.Tx, build *artifacts.Build, metadata map[string]string) error {
+	_, err := tx.Exec(ctx, "delete from build_metadata where job=$1 and build_id=$2", build.Job, build.BuildID)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	_, err = tx.CopyFrom(
+		ctx,
+		pgx.Identifier{"build_metadata"},
+		[]string{"job", "build_id", "key", "value"},
+		pgx.CopyFromSlice(len(keys), func(i int) ([]interface{}, error) {
+			return []interface{}{build.Job, build.BuildID, keys[i], metadata[keys[i]]}, nil
+		}),
 	)
 	return err
 }
 
-func loadBuildStatus(ctx context.Context, conn *pgx.Conn, build *artifacts.Build) (*artifacts.BuildStatus, error) {
+func loadBuildStatus(ctx context.Context, conn querier, build *artifacts.Build) (*artifacts.BuildStatus, error) {
 	status := &artifacts.BuildStatus{}
 	err := conn.QueryRow(
 		ctx,
@@ -76,6 +123,7 @@ func loadBuildStatus(ctx context.Context, conn *pgx.Conn, build *artifacts.Build
 type DBTestResult struct {
 	Job               string
 	BuildID           string
+	Suite             string
 	Test              string
 	FinishedTimestamp int64
 	Attempt           int
@@ -83,175 +131,324 @@ type DBTestResult struct {
 	Status            int
 	Output            string
 	Signature         string
+	SignatureVersion  int
+
+	// OutputReduced is true if the stored output is not the one that the
+	// signature was generated from, e.g. because of the retention policy.
+	OutputReduced bool
+
+	// Fingerprint is the failure location or the top stack frames of a
+	// panic, see signature.Fingerprint.
+	Fingerprint string
+
+	// DurationMs is nil if the duration of the test is unknown.
+	DurationMs *int64
+
+	// Properties is a JSON object, or nil if the test has no properties.
+	Properties *string
+	SystemOut  string
+	SystemErr  string
 }
 
-func saveTestResult(ctx context.Context, conn *pgx.Conn, result *DBTestResult) error {
-	klog.V(5).Infof("Saving %s @ %s: %s...", result.Job, result.BuildID, result.Test)
+var testResultColumns = []string{"job", "build_id", "suite", "test", "finished_timestamp", "attempt", "attempts", "status", "output_hash", "output_reduced", "signature", "signature_version", "fingerprint", "duration_ms", "properties", "system_out", "system_err"}
+
+func (r *DBTestResult) values() []interface{} {
+	return []interface{}{
+		r.Job,
+		r.BuildID,
+		r.Suite,
+		r.Test,
+		r.FinishedTimestamp,
+		r.Attempt,
+		r.Attempts,
+		r.Status,
+		outputHash(r.Output),
+		r.OutputReduced,
+		r.Signature,
+		r.SignatureVersion,
+		r.Fingerprint,
+		r.DurationMs,
+		r.Properties,
+		r.SystemOut,
+		r.SystemErr,
+	}
+}
 
-	_, err := conn.Exec(
+// outputHash returns the key of output in the outputs table. Empty outputs
+// are not stored.
+func outputHash(output string) []byte {
+	if output == "" {
+		return nil
+	}
+	h := sha256.Sum256([]byte(output))
+	return h[:]
+}
+
+// saveOutputs stores the outputs of results in the content-addressed outputs
+// table. Existing rows are touched, so that they are locked until the
+// transaction commits and can't be garbage collected before the test results
+// that refer to them are visible. Rows are locked in the order of their
+// hashes, so that concurrent builds with common outputs don't deadlock.
+func saveOutputs(ctx context.Context, tx pgx.Tx, results []*DBTestResult) error {
+	byHash := map[string]string{}
+	for _, r := range results {
+		if hash := outputHash(r.Output); hash != nil {
+			byHash[string(hash)] = r.Output
+		}
+	}
+	if len(byHash) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(byHash))
+	for hash := range byHash {
+		keys = append(keys, hash)
+	}
+	sort.Strings(keys)
+	hashes := make([][]byte, len(keys))
+	outputs := make([]string, len(keys))
+	for i, hash := range keys {
+		hashes[i] = []byte(hash)
+		outputs[i] = byHash[hash]
+	}
+
+	_, err := tx.Exec(
 		ctx,
-		"insert into test_results (job, build_id, test, finished_timestamp, attempt, attempts, status, output, signature) values ($1, $2, $3, $4, $5, $6, $7, $8, $9) on conflict do nothing",
-		result.Job,
-		result.BuildID,
-		result.Test,
-		result.FinishedTimestamp,
-		result.Attempt,
-		result.Attempts,
-		result.Status,
-		result.Output,
-		result.Signature,
+		`insert into outputs (hash, output)
+		select hash, output from unnest($1::bytea[], $2::text[]) as t (hash, output) order by hash
+		on conflict (hash) do update set hash = excluded.hash`,
+		hashes, outputs,
 	)
 	return err
 }
 
-var (
-	excludeLineRe = regexp.MustCompile(`(?i)(?:INFO: .* event for)`)
-	errorLineRe   = regexp.MustCompile(`(?i)(?:error|fail|unable|illegal|violation|forbidden|cannot|can't|should not|did not|didn't|isn't|is not|aren't|are not|timed?.?out|unavailable)`)
-)
+// saveTestResults replaces the test results of the build job/buildID with
+// results. It should be called within a transaction.
+func saveTestResults(ctx context.Context, tx pgx.Tx, job, buildID string, results []*DBTestResult) error {
+	klog.V(5).Infof("Saving %d test results for %s @ %s...", len(results), job, buildID)
+
+	// Builds that were partially saved before indexing became transactional
+	// may have stale rows.
+	_, err := tx.Exec(ctx, "delete from test_results where job=$1 and build_id=$2", job, buildID)
+	if err != nil {
+		return err
+	}
 
-func generateSignature(data string) string {
-	errorLines := map[string]bool{}
-	for _, line := range strings.Split(data, "\n") {
-		line = denoise.Denoise(line)
-		if errorLineRe.MatchString(line) && !excludeLineRe.MatchString(line) {
-			errorLines[line] = true
+	err = saveOutputs(ctx, tx, results)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.CopyFrom(
+		ctx,
+		pgx.Identifier{"test_results"},
+		testResultColumns,
+		pgx.CopyFromSlice(len(results), func(i int) ([]interface{}, error) {
+			return results[i].values(), nil
+		}),
+	)
+	return err
+}
+
+// applyOutputRule returns the part of output that should be stored according
+// to rule. Error lines are detected using rules. Omitted parts are replaced
+// by a note that points to the build artifacts.
+func applyOutputRule(output string, rule config.OutputRule, rules *signature.Rules) string {
+	if output == "" {
+		return output
+	}
+	switch rule.Keep {
+	case config.KeepNone:
+		return ""
+	case config.KeepHead:
+		if len(output) <= rule.HeadBytes {
+			return output
+		}
+		head := output[:rule.HeadBytes]
+		if i := strings.LastIndexByte(head, '\n'); i >= 0 {
+			head = head[:i]
+		} else {
+			head = strings.ToValidUTF8(head, "")
+		}
+		return fmt.Sprintf("%s\n[deepgrid: output truncated by the retention policy, %d of %d bytes omitted, see the build artifacts]", head, len(output)-len(head), len(output))
+	case config.KeepErrors:
+		lines := strings.Split(output, "\n")
+		var kept []string
+		for _, line := range lines {
+			if rules.IsErrorLine(line) {
+				kept = append(kept, line)
+			}
+		}
+		if len(kept) == len(lines) {
+			return output
 		}
+		kept = append(kept, fmt.Sprintf("[deepgrid: only error lines are kept by the retention policy, %d of %d lines omitted, see the build artifacts]", len(lines)-len(kept), len(lines)))
+		return strings.Join(kept, "\n")
+	}
+	return output
+}
+
+// newArtifactsClient returns a client that supports gs://, s3:// and file://
+// locations and parses test results and build logs according to cfg.
+func newArtifactsClient(ctx context.Context, maxDownloads int, cfg *config.Config) (*artifacts.Client, error) {
+	gcsClient, err := storage.NewClient(ctx, option.WithoutAuthentication())
+	if err != nil {
+		return nil, err
+	}
+
+	s3Storage, err := artifacts.NewS3StorageFromEnv()
+	if err != nil {
+		return nil, err
 	}
 
-	var lines []string
-	for line := range errorLines {
-		lines = append(lines, line)
+	client := artifacts.NewClient(maxDownloads)
+	client.RegisterStorage("gs", artifacts.NewGCSStorage(gcsClient), true)
+	client.RegisterStorage("s3", s3Storage, true)
+	client.RegisterStorage("file", artifacts.NewLocalStorage("/"), false)
+	for _, f := range cfg.ResultFormats {
+		err = client.RegisterResultFormat(f.Format, f.Pattern)
+		if err != nil {
+			return nil, err
+		}
 	}
-	sort.Strings(lines)
-	return strings.Join(lines, "\n")
+	client.SetLogLimits(artifacts.LogLimits{
+		MaxBytes:     cfg.Logs.MaxBytes,
+		HeadBytes:    cfg.Logs.HeadBytes,
+		ContextLines: cfg.Logs.ContextLines,
+		MaxLineBytes: cfg.Logs.MaxLineBytes,
+		IsErrorLine:  cfg.Signature.IsErrorLine,
+	})
+	return client, nil
+}
+
+var indexOpts struct {
+	workers   int
+	downloads int
+	dbWriters int
+	backfill  bool
+	watch     bool
+	interval  time.Duration
+
+	gcInterval time.Duration
+	gc         gcOptions
 }
 
 func init() {
 	rootCmd.AddCommand(indexCmd)
+
+	indexCmd.Flags().IntVar(&indexOpts.workers, "workers", 16, "number of builds that are processed concurrently")
+	indexCmd.Flags().IntVar(&indexOpts.downloads, "downloads", 8, "maximum number of concurrent requests to the artifact storage")
+	indexCmd.Flags().IntVar(&indexOpts.dbWriters, "db-writers", 4, "maximum number of concurrent database connections")
+	indexCmd.Flags().BoolVar(&indexOpts.backfill, "backfill", false, "walk older builds until days_of_results is covered instead of looking only at the newest max_builds builds; in --watch mode only the first pass backfills")
+	indexCmd.Flags().BoolVar(&indexOpts.watch, "watch", false, "keep running and poll test groups for new builds")
+	indexCmd.Flags().DurationVar(&indexOpts.interval, "interval", 5*time.Minute, "delay between polls in --watch mode")
+	indexCmd.Flags().DurationVar(&indexOpts.gcInterval, "gc-interval", 0, "run the garbage collector with this interval in --watch mode (0 disables it)")
+	addGCFlags(indexCmd, &indexOpts.gc)
 }
 
 var indexCmd = &cobra.Command{
 	Use:   "index",
-	Short: "Print the version number of Hugo",
-	Long:  `All software has versions. This is Hugo's`,
+	Short: "Index test results of the test groups from config.yaml",
+	Long: `Index test results of the test groups from config.yaml.
+
+Builds of every test group are listed in the artifact storage from the newest
+to the oldest one, and the builds that are not indexed yet are downloaded and
+parsed. Test results, build logs and metadata of a build are saved in a single
+transaction. Builds that fail to be indexed are recorded and retried with a
+backoff.
+
+--workers builds are processed concurrently, at most --downloads requests are
+made to the artifact storage at a time, and at most --db-writers database
+connections are used.
+
+By default a single pass over the newest max_builds builds of every test group
+is made. --backfill walks all builds within days_of_results instead. --watch
+keeps polling for new builds every --interval and, if --gc-interval is set,
+runs the garbage collector.
+
+On SIGINT or SIGTERM no new builds are scheduled, and the command exits once
+the builds that are being processed are saved.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.Background()
 
-		conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+		if indexOpts.workers < 1 || indexOpts.downloads < 1 || indexOpts.dbWriters < 1 {
+			klog.Exitf("--workers, --downloads and --db-writers must be positive")
+		}
+
+		poolConfig, err := pgxpool.ParseConfig(os.Getenv("DATABASE_URL"))
+		if err != nil {
+			klog.Exitf("Unable to parse DATABASE_URL: %s", err)
+		}
+
+		poolConfig.MaxConns = int32(indexOpts.dbWriters)
+
+		pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
 		if err != nil {
 			klog.Exitf("Unable to connect to database: %s", err)
 		}
-		defer conn.Close(ctx)
+		defer pool.Close()
 
 		cfg, err := config.LoadFromFile("./config.yaml")
 		if err != nil {
 			klog.Fatal(err)
 		}
 
-		gcsClient, err := storage.NewClient(ctx, option.WithoutAuthentication())
+		client, err := newArtifactsClient(ctx, indexOpts.downloads, cfg)
 		if err != nil {
 			klog.Fatal(err)
 		}
 
-		client := artifacts.NewClient(gcsClient)
+		redactor, err := redact.New(cfg.Redaction.Patterns)
+		if err != nil {
+			klog.Fatal(err)
+		}
 
-		for _, testGroup := range cfg.TestGroups {
-			builds, err := client.FindBuilds(ctx, testGroup.Name, testGroup.GCSPrefix)
+		ix := newIndexer(pool, client, redactor, indexOpts.workers)
+		ix.backfill = indexOpts.backfill
+
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			klog.Infof("Received %s, waiting for in-flight builds to finish...", sig)
+			close(stop)
+			sig = <-signals
+			klog.Exitf("Received %s, exiting immediately", sig)
+		}()
+
+		if !indexOpts.watch {
+			err = ix.indexTestGroups(ctx, stop, cfg.TestGroups)
 			if err != nil {
-				klog.Fatal(err)
-			}
-
-			const maxBuilds = 5
-			if len(builds) > maxBuilds {
-				builds = builds[len(builds)-maxBuilds:]
+				klog.Exit(err)
 			}
+			return
+		}
 
-			for _, build := range builds {
-				status, err := loadBuildStatus(ctx, conn, build)
-				if err == nil {
-					continue
-				} else if err != pgx.ErrNoRows {
-					klog.Fatal(err)
-				}
-
-				buildMetaCached := true
-				buildMeta, err := loadBuildMeta(ctx, conn, build)
-				if err == pgx.ErrNoRows {
-					buildMeta, err = client.GetBuildMeta(ctx, build)
-					if err != nil {
-						klog.Fatal(err)
-					}
-					buildMetaCached = false
-				} else if err != nil {
-					klog.Fatal(err)
-				}
-
-				status, err = client.GetBuildStatus(ctx, buildMeta)
-				if err == artifacts.ErrNotFound {
-					continue
-				} else if err != nil {
-					klog.Fatal(err)
-				}
-
-				if !buildMetaCached {
-					err = saveBuildMeta(ctx, conn, buildMeta)
-					if err != nil {
-						klog.Fatal(err)
-					}
-				}
-
-				//if status.FinishedTimestamp < time.Now().Unix()-24*60*60 {
-				//	continue
-				//}
-
-				resultsList, err := client.GetTestResults(ctx, buildMeta)
-				if err != nil {
-					klog.Fatal(err)
-				}
-
-				buildLogs, err := client.GetBuildLogs(ctx, buildMeta)
+		var lastGC time.Time
+		for {
+			if indexOpts.gcInterval != 0 && time.Since(lastGC) >= indexOpts.gcInterval {
+				err = runGC(ctx, pool, cfg.TestGroups, indexOpts.gc)
 				if err != nil {
-					klog.Fatal(err)
-				}
-
-				resultsList = append(resultsList, buildLogs...)
-
-				results := map[string][]*artifacts.TestResult{}
-				for _, result := range resultsList {
-					if result.Status == artifacts.TestStatusSuccess {
-						for _, prev := range results[result.Test] {
-							if prev.Status == artifacts.TestStatusFailure {
-								prev.Status = artifacts.TestStatusFlake
-							}
-						}
-					}
-					results[result.Test] = append(results[result.Test], result)
+					klog.Errorf("Garbage collection failed: %s", err)
 				}
+				lastGC = time.Now()
+			}
 
-				for test, testResults := range results {
-					for i, r := range testResults {
-						dbTestResult := &DBTestResult{
-							Job:               build.Job,
-							BuildID:           build.BuildID,
-							Test:              test,
-							FinishedTimestamp: status.FinishedTimestamp,
-							Attempt:           i - len(testResults) + 1,
-							Attempts:          len(testResults),
-							Status:            int(r.Status),
-							Output:            r.Output,
-							Signature:         generateSignature(r.Output),
-						}
-						err = saveTestResult(ctx, conn, dbTestResult)
-						if err != nil {
-							klog.Fatal(err)
-						}
-					}
-				}
+			startTime := time.Now()
+			err = ix.indexTestGroups(ctx, stop, cfg.TestGroups)
+			if err == errInterrupted {
+				return
+			} else if err != nil {
+				klog.Errorf("Indexing pass failed: %s", err)
+			}
+			klog.Infof("Indexing pass took %s", time.Since(startTime))
+			ix.backfill = false
 
-				err = saveBuildStatus(ctx, conn, build, status)
-				if err != nil {
-					klog.Fatal(err)
-				}
+			select {
+			case <-stop:
+				return
+			case <-time.After(indexOpts.interval):
 			}
 		}
 	},
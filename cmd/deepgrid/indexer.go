@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dmage/deepgrid/pkg/artifacts"
+	"github.com/dmage/deepgrid/pkg/config"
+	"github.com/dmage/deepgrid/pkg/redact"
+	"github.com/dmage/deepgrid/pkg/signature"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"k8s.io/klog/v2"
+)
+
+// errNotFinished is returned by indexBuild for builds that don't have
+// finished.json yet. Such builds should be retried later.
+var errNotFinished = errors.New("build is not finished yet")
+
+// errBackoff is returned by processBuild for failed builds that should not be
+// retried yet.
+var errBackoff = errors.New("build is waiting for a retry")
+
+// errOutsideWindow is returned by indexBuild for builds that are older than
+// the retention window of their test group.
+var errOutsideWindow = errors.New("build is outside of the retention window")
+
+// errInterrupted is returned by indexTestGroups if stop was closed before all
+// builds were scheduled.
+var errInterrupted = errors.New("indexing pass was interrupted")
+
+type indexer struct {
+	pool     *pgxpool.Pool
+	client   *artifacts.Client
+	redactor *redact.Redactor
+	workers  int
+
+	// backfill makes the next pass walk all builds within the retention
+	// window rather than only new ones.
+	backfill bool
+
+	// cursors holds, for every job, the build ID from which the next listing
+	// should start. All builds before the cursor have already been looked at.
+	cursors map[string]string
+}
+
+func newIndexer(pool *pgxpool.Pool, client *artifacts.Client, redactor *redact.Redactor, workers int) *indexer {
+	return &indexer{
+		pool:     pool,
+		client:   client,
+		redactor: redactor,
+		workers:  workers,
+		cursors:  map[string]string{},
+	}
+}
+
+// processBuild indexes build unless it's waiting for a retry after a
+// failure. Failures are recorded in the index_errors table.
+func (ix *indexer) processBuild(ctx context.Context, task buildTask) error {
+	build := task.build
+	if task.indexError != nil && time.Now().Before(task.indexError.NextAttempt()) {
+		return errBackoff
+	}
+
+	err := ix.indexBuild(ctx, build, task.cutoff, task.testGroup)
+	if err == nil {
+		if task.indexError != nil {
+			err = deleteIndexError(ctx, ix.pool, build)
+			if err != nil {
+				klog.Errorf("Unable to delete index error for %s: %s", build, err)
+			}
+		}
+		return nil
+	}
+	if err == errNotFinished || err == errOutsideWindow {
+		return err
+	}
+
+	stage := stageUnknown
+	var se *stageError
+	if errors.As(err, &se) {
+		stage = se.stage
+	}
+	saveErr := saveIndexError(ctx, ix.pool, build, stage, err.Error())
+	if saveErr != nil {
+		klog.Errorf("Unable to record index error for %s: %s", build, saveErr)
+	}
+	return err
+}
+
+func (ix *indexer) indexBuild(ctx context.Context, build *artifacts.Build, cutoff int64, testGroup *config.TestGroup) error {
+	status, err := loadBuildStatus(ctx, ix.pool, build)
+	if err == nil {
+		if status.StartedTimestamp < cutoff {
+			return errOutsideWindow
+		}
+		return nil
+	} else if err != pgx.ErrNoRows {
+		return &stageError{stage: stageLoad, err: err}
+	}
+
+	err = ix.client.ResolveBuild(ctx, build)
+	if err != nil {
+		return &stageError{stage: stageMeta, err: err}
+	}
+
+	buildMetaCached := true
+	buildMeta, err := loadBuildMeta(ctx, ix.pool, build)
+	if err == pgx.ErrNoRows {
+		buildMeta, err = ix.client.GetBuildMeta(ctx, build)
+		if err != nil {
+			return &stageError{stage: stageMeta, err: err}
+		}
+		buildMetaCached = false
+	} else if err != nil {
+		return &stageError{stage: stageLoad, err: err}
+	}
+
+	status, err = ix.client.GetBuildStatus(ctx, buildMeta)
+	if err == artifacts.ErrNotFound {
+		return errNotFinished
+	} else if err != nil {
+		return &stageError{stage: stageStatus, err: err}
+	}
+
+	if status.StartedTimestamp < cutoff {
+		return errOutsideWindow
+	}
+
+	metadata, err := ix.client.GetBuildMetadata(ctx, buildMeta)
+	if err != nil {
+		return &stageError{stage: stageMetadata, err: err}
+	}
+
+	resultsList, err := ix.client.GetTestResults(ctx, buildMeta)
+	if err != nil {
+		return &stageError{stage: stageResults, err: err}
+	}
+
+	buildLogs, err := ix.client.GetBuildLogs(ctx, buildMeta)
+	if err != nil {
+		return &stageError{stage: stageLogs, err: err}
+	}
+
+	resultsList = append(resultsList, buildLogs...)
+
+	if testGroup.GoTest != nil {
+		goTestResults, err := ix.client.GetGoTestResults(ctx, buildMeta, testGroup.GoTest.MatchFile)
+		if err != nil {
+			return &stageError{stage: stageResults, err: err}
+		}
+		resultsList = append(resultsList, goTestResults...)
+	}
+
+	results := map[testID][]*artifacts.TestResult{}
+	var tests []testID
+	for _, result := range resultsList {
+		id := testID{Suite: result.Suite, Test: result.Test}
+		if result.Status == artifacts.TestStatusSuccess {
+			for _, prev := range results[id] {
+				if prev.Status == artifacts.TestStatusFailure {
+					prev.Status = artifacts.TestStatusFlake
+				}
+			}
+		}
+		if _, ok := results[id]; !ok {
+			tests = append(tests, id)
+		}
+		results[id] = append(results[id], result)
+	}
+	sort.Slice(tests, func(i, j int) bool {
+		if tests[i].Suite != tests[j].Suite {
+			return tests[i].Suite < tests[j].Suite
+		}
+		return tests[i].Test < tests[j].Test
+	})
+
+	err = ix.saveBuild(ctx, buildMeta, buildMetaCached, status, metadata, tests, results, testGroup)
+	if err != nil {
+		return &stageError{stage: stageSave, err: err}
+	}
+	return nil
+}
+
+// testID identifies a test within a build. Tests with the same name may be
+// in different suites.
+type testID struct {
+	Suite string
+	Test  string
+}
+
+// saveBuild stores the results of the build. The signatures are generated
+// from the full outputs, but only the parts of the outputs that are allowed
+// by the retention policy of testGroup are stored.
+func (ix *indexer) saveBuild(ctx context.Context, buildMeta *artifacts.BuildMeta, buildMetaCached bool, status *artifacts.BuildStatus, metadata map[string]string, tests []testID, results map[testID][]*artifacts.TestResult, testGroup *config.TestGroup) error {
+	build := buildMeta.Build
+
+	// Secrets are removed before anything derived from the outputs is
+	// computed or stored.
+	redactions := 0
+	for _, test := range tests {
+		for _, r := range results[test] {
+			redactions += ix.redact(r)
+		}
+	}
+	redactions += ix.redactValues(metadata)
+	if redactions > 0 {
+		klog.V(2).Infof("Redacted %d secrets in %s", redactions, build)
+	}
+
+	var dbTestResults []*DBTestResult
+	for _, test := range tests {
+		testResults := results[test]
+		for i, r := range testResults {
+			var properties *string
+			if len(r.Properties) != 0 {
+				buf, err := json.Marshal(r.Properties)
+				if err != nil {
+					return err
+				}
+				s := string(buf)
+				properties = &s
+			}
+			var durationMs *int64
+			if r.HasDuration && r.Status != artifacts.TestStatusInfo && r.Status != artifacts.TestStatusSkipped {
+				ms := r.Duration.Milliseconds()
+				durationMs = &ms
+			}
+			rule := testGroup.Retention.OutputRule(strings.ToLower(r.Status.String()))
+			output := applyOutputRule(r.Output, rule, testGroup.Signature)
+			dbTestResults = append(dbTestResults, &DBTestResult{
+				Job:               build.Job,
+				BuildID:           build.BuildID,
+				Suite:             test.Suite,
+				Test:              test.Test,
+				FinishedTimestamp: status.FinishedTimestamp,
+				Attempt:           i - len(testResults) + 1,
+				Attempts:          len(testResults),
+				Status:            int(r.Status),
+				Output:            output,
+				Signature:         testGroup.Signature.Generate(r.Output),
+				SignatureVersion:  testGroup.Signature.Version,
+				OutputReduced:     output != r.Output,
+				Fingerprint:       signature.Fingerprint(r.Output),
+				DurationMs:        durationMs,
+				Properties:        properties,
+				SystemOut:         applyOutputRule(r.SystemOut, rule, testGroup.Signature),
+				SystemErr:         applyOutputRule(r.SystemErr, rule, testGroup.Signature),
+			})
+		}
+	}
+
+	// All writes for a build go through a single connection, so the number
+	// of concurrent writers is bounded by the size of the pool.
+	conn, err := ix.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	// The build status is the marker that the build is indexed, so it's
+	// saved in the same transaction as the test results.
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if !buildMetaCached {
+		err = saveBuildMeta(ctx, tx, buildMeta)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = saveBuildMetadata(ctx, tx, build, metadata)
+	if err != nil {
+		return err
+	}
+
+	err = saveTestResults(ctx, tx, build.Job, build.BuildID, dbTestResults)
+	if err != nil {
+		return err
+	}
+
+	err = saveBuildStatus(ctx, tx, build, status, redactions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// redact removes secrets from the outputs and properties of r and returns
+// their number.
+func (ix *indexer) redact(r *artifacts.TestResult) int {
+	var n, count int
+	r.Output, n = ix.redactor.Redact(r.Output)
+	count += n
+	r.SystemOut, n = ix.redactor.Redact(r.SystemOut)
+	count += n
+	r.SystemErr, n = ix.redactor.Redact(r.SystemErr)
+	count += n
+	count += ix.redactValues(r.Properties)
+	return count
+}
+
+// redactValues removes secrets from the values of m and returns their number.
+func (ix *indexer) redactValues(m map[string]string) int {
+	count := 0
+	for key, value := range m {
+		value, n := ix.redactor.Redact(value)
+		m[key] = value
+		count += n
+	}
+	return count
+}
+
+type buildTask struct {
+	build *artifacts.Build
+
+	// indexError is the last failure to index build, if any.
+	indexError *IndexError
+
+	// cutoff is the Unix timestamp before which builds are out of the
+	// retention window. Zero means that the window is not limited by time.
+	cutoff int64
+
+	// testGroup is the test group of the build.
+	testGroup *config.TestGroup
+}
+
+type buildOutcome struct {
+	build *artifacts.Build
+	err   error
+}
+
+// windowExhausted tracks jobs for which a build outside of the retention
+// window has been seen. Older builds of such jobs are not scheduled.
+type windowExhausted struct {
+	mu   sync.Mutex
+	jobs map[string]bool
+}
+
+func (w *windowExhausted) set(job string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.jobs[job] = true
+}
+
+func (w *windowExhausted) get(job string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.jobs[job]
+}
+
+// indexTestGroups runs a single indexing pass over testGroups. Builds are
+// processed by ix.workers goroutines using ctx. Once stop is done, no new
+// builds are scheduled, but the builds that are already being processed are
+// finished, and errInterrupted is returned.
+//
+// Builds of each test group are walked from the newest to the oldest one. The
+// first pass looks only at the newest MaxBuilds builds. Later passes look at
+// the builds that were not seen by the previous passes, at most MaxBuilds of
+// them, starting from the oldest ones. A backfill pass looks at all builds
+// until it finds one that is older than DaysOfResults.
+func (ix *indexer) indexTestGroups(ctx context.Context, stop <-chan struct{}, testGroups []config.TestGroup) error {
+	indexErrors, err := loadIndexErrors(ctx, ix.pool, "")
+	if err != nil {
+		return fmt.Errorf("unable to load index errors: %w", err)
+	}
+	indexErrorsByBuild := map[string]map[string]*IndexError{}
+	for _, e := range indexErrors {
+		if indexErrorsByBuild[e.Job] == nil {
+			indexErrorsByBuild[e.Job] = map[string]*IndexError{}
+		}
+		indexErrorsByBuild[e.Job][e.BuildID] = e
+	}
+
+	tasks := make(chan buildTask)
+	outcomes := make(chan buildOutcome)
+	exhausted := &windowExhausted{jobs: map[string]bool{}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < ix.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				outcomes <- buildOutcome{
+					build: task.build,
+					err:   ix.processBuild(ctx, task),
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(outcomes)
+	}()
+
+	var listErr error
+	interrupted := false
+	go func() {
+		defer close(tasks)
+		for g := range testGroups {
+			testGroup := &testGroups[g]
+			since := ix.cursors[testGroup.Name]
+			if ix.backfill {
+				since = ""
+			}
+
+			found, err := ix.client.FindBuilds(ctx, testGroup.Name, testGroup.GCSPrefix, since)
+			if err != nil {
+				klog.Errorf("Unable to find builds for %s: %s", testGroup.Name, err)
+				listErr = err
+				continue
+			}
+
+			if !ix.backfill && testGroup.MaxBuilds > 0 && len(found) > testGroup.MaxBuilds {
+				if since == "" {
+					found = found[len(found)-testGroup.MaxBuilds:]
+				} else {
+					// The cursor doesn't move past the builds that are
+					// left, so the next pass picks them up.
+					found = found[:testGroup.MaxBuilds]
+				}
+			}
+
+			var cutoff int64
+			if testGroup.DaysOfResults > 0 {
+				cutoff = time.Now().Add(-time.Duration(testGroup.DaysOfResults) * 24 * time.Hour).Unix()
+			}
+
+			for i := len(found) - 1; i >= 0; i-- {
+				if exhausted.get(testGroup.Name) {
+					break
+				}
+				task := buildTask{
+					build:      found[i],
+					indexError: indexErrorsByBuild[found[i].Job][found[i].BuildID],
+					cutoff:     cutoff,
+					testGroup:  testGroup,
+				}
+				select {
+				case tasks <- task:
+				case <-stop:
+					interrupted = true
+					return
+				}
+			}
+		}
+	}()
+
+	failed := 0
+	pending := map[string][]string{}
+	latest := map[string]string{}
+	for outcome := range outcomes {
+		build := outcome.build
+		if artifacts.CompareBuildIDs(build.BuildID, latest[build.Job]) > 0 {
+			latest[build.Job] = build.BuildID
+		}
+		switch outcome.err {
+		case nil:
+		case errOutsideWindow:
+			klog.V(2).Infof("Skipping %s: %s", build, outcome.err)
+			exhausted.set(build.Job)
+		case errNotFinished, errBackoff:
+			klog.V(2).Infof("Skipping %s: %s", build, outcome.err)
+			pending[build.Job] = append(pending[build.Job], build.BuildID)
+		default:
+			klog.Errorf("Unable to index %s: %s", build, outcome.err)
+			pending[build.Job] = append(pending[build.Job], build.BuildID)
+			failed++
+		}
+	}
+
+	for job, buildID := range latest {
+		for _, p := range pending[job] {
+			if artifacts.CompareBuildIDs(p, buildID) < 0 {
+				buildID = p
+			}
+		}
+		ix.cursors[job] = buildID
+	}
+
+	if interrupted {
+		return errInterrupted
+	}
+	if listErr != nil {
+		return listErr
+	}
+	if failed > 0 {
+		return fmt.Errorf("unable to index %d builds", failed)
+	}
+	return nil
+}
@@ -3,13 +3,11 @@ package main
 import (
 	goflag "flag"
 
-	"github.com/spf13/pflag"
 	"k8s.io/klog/v2"
 )
 
 func main() {
 	klog.InitFlags(nil)
-	pflag.CommandLine.AddGoFlagSet(goflag.CommandLine)
-	pflag.Parse()
+	rootCmd.PersistentFlags().AddGoFlagSet(goflag.CommandLine)
 	Execute()
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/dmage/deepgrid/pkg/config"
+	"github.com/dmage/deepgrid/pkg/signature"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+type resignatureRow struct {
+	Job         string
+	BuildID     string
+	Suite       string
+	Test        string
+	Attempt     int32
+	Output      string
+	Signature   string
+	Fingerprint string
+
+	// OutputReduced is true if the stored output is not the one that the
+	// signature was generated from. Such rows can't be updated.
+	OutputReduced bool
+}
+
+// loadResignatureBatch returns up to limit test results of job that come
+// after the row last (in the order of the unique index) and whose signatures
+// were not generated by the given version of the rules.
+func loadResignatureBatch(ctx context.Context, conn querier, job string, version int, finishedAfter int64, last *resignatureRow, limit int) ([]*resignatureRow, error) {
+	rows, err := conn.Query(
+		ctx,
+		`select tr.job, tr.build_id, tr.suite, tr.test, tr.attempt, tr.output_reduced,
+			case when tr.output_reduced then '' else coalesce(o.output, '') end, tr.signature
+		from test_results tr
+		left join outputs o on o.hash = tr.output_hash
+		where (tr.job, tr.build_id, tr.suite, tr.test, tr.attempt) > ($1, $2, $3, $4, $5)
+			and (tr.signature_version is null or tr.signature_version <> $6)
+			and tr.job = $7 and tr.finished_timestamp > $8
+		order by tr.job, tr.build_id, tr.suite, tr.test, tr.attempt
+		limit $9`,
+		last.Job, last.BuildID, last.Suite, last.Test, last.Attempt, version, job, finishedAfter, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []*resignatureRow
+	for rows.Next() {
+		r := &resignatureRow{}
+		var signature *string
+		err = rows.Scan(&r.Job, &r.BuildID, &r.Suite, &r.Test, &r.Attempt, &r.OutputReduced, &r.Output, &signature)
+		if err != nil {
+			return nil, err
+		}
+		if signature != nil {
+			r.Signature = *signature
+		}
+		batch = append(batch, r)
+	}
+	return batch, rows.Err()
+}
+
+func saveResignatureBatch(ctx context.Context, conn querier, version int, batch []*resignatureRow) error {
+	var jobs, buildIDs, suites, tests, signatures, fingerprints []string
+	var attempts []int32
+	for _, r := range batch {
+		jobs = append(jobs, r.Job)
+		buildIDs = append(buildIDs, r.BuildID)
+		suites = append(suites, r.Suite)
+		tests = append(tests, r.Test)
+		attempts = append(attempts, r.Attempt)
+		signatures = append(signatures, r.Signature)
+		fingerprints = append(fingerprints, r.Fingerprint)
+	}
+	_, err := conn.Exec(
+		ctx,
+		`update test_results tr
+		set signature = u.signature, signature_version = $1, fingerprint = u.fingerprint
+		from unnest($2::text[], $3::text[], $4::text[], $5::text[], $6::int[], $7::text[], $8::text[]) as u(job, build_id, suite, test, attempt, signature, fingerprint)
+		where tr.job = u.job and tr.build_id = u.build_id and tr.suite = u.suite and tr.test = u.test and tr.attempt = u.attempt`,
+		version, jobs, buildIDs, suites, tests, attempts, signatures, fingerprints,
+	)
+	return err
+}
+
+var resignatureOpts struct {
+	job       string
+	age       time.Duration
+	batchSize int
+	pause     time.Duration
+}
+
+func init() {
+	rootCmd.AddCommand(resignatureCmd)
+
+	resignatureCmd.Flags().StringVar(&resignatureOpts.job, "job", "", "regular expression for job names")
+	resignatureCmd.Flags().DurationVar(&resignatureOpts.age, "age", 0, "only update test results that finished within this duration (0 means all)")
+	resignatureCmd.Flags().IntVar(&resignatureOpts.batchSize, "batch-size", 1000, "number of test results that are updated in one transaction")
+	resignatureCmd.Flags().DurationVar(&resignatureOpts.pause, "pause", 0, "delay between batches")
+}
+
+var resignatureCmd = &cobra.Command{
+	Use:   "resignature",
+	Short: "Recompute signatures of test results after the signature rules change",
+	Long: `Recompute signatures of test results that were generated by an older
+version of the signature rules.
+
+The rules and their versions are taken from config.yaml, test results of jobs
+that are not listed in the configuration are not updated.
+
+Test results whose outputs were reduced by the retention policy or the garbage
+collector keep their signatures, as the full outputs are no longer available.
+Their number is reported.
+
+Test results are updated in small batches, each in its own transaction, so the
+command can be run while the indexer and the web UI are working.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		if resignatureOpts.batchSize < 1 {
+			klog.Exitf("--batch-size must be positive")
+		}
+
+		conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+		if err != nil {
+			klog.Exitf("Unable to connect to database: %s", err)
+		}
+		defer conn.Close(ctx)
+
+		finishedAfter := int64(0)
+		if resignatureOpts.age != 0 {
+			finishedAfter = time.Now().Add(-resignatureOpts.age).Unix()
+		}
+
+		jobRe, err := regexp.Compile(resignatureOpts.job)
+		if err != nil {
+			klog.Exitf("Invalid --job: %s", err)
+		}
+
+		cfg, err := config.LoadFromFile("./config.yaml")
+		if err != nil {
+			klog.Fatal(err)
+		}
+
+		startTime := time.Now()
+		processed, changed, skipped := 0, 0, 0
+		for _, testGroup := range cfg.TestGroups {
+			if !jobRe.MatchString(testGroup.Name) {
+				continue
+			}
+			rules := testGroup.Signature
+
+			last := &resignatureRow{}
+			for {
+				batch, err := loadResignatureBatch(ctx, conn, testGroup.Name, rules.Version, finishedAfter, last, resignatureOpts.batchSize)
+				if err != nil {
+					klog.Exit(err)
+				}
+				if len(batch) == 0 {
+					break
+				}
+
+				var updates []*resignatureRow
+				for _, r := range batch {
+					if r.OutputReduced {
+						skipped++
+						continue
+					}
+					sig := rules.Generate(r.Output)
+					if sig != r.Signature {
+						changed++
+					}
+					r.Signature = sig
+					r.Fingerprint = signature.Fingerprint(r.Output)
+					updates = append(updates, r)
+				}
+
+				if len(updates) != 0 {
+					err = saveResignatureBatch(ctx, conn, rules.Version, updates)
+					if err != nil {
+						klog.Exit(err)
+					}
+				}
+
+				processed += len(updates)
+				last = batch[len(batch)-1]
+				klog.V(2).Infof("Updated %d test results (%d signatures changed), last: %s @ %s", processed, changed, last.Job, last.BuildID)
+
+				if resignatureOpts.pause != 0 {
+					time.Sleep(resignatureOpts.pause)
+				}
+			}
+		}
+
+		klog.Infof("Updated %d test results (%d signatures changed) in %s", processed, changed, time.Since(startTime))
+		if skipped != 0 {
+			klog.Warningf("Skipped %d test results whose outputs were reduced by the retention policy", skipped)
+		}
+	},
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dmage/deepgrid/pkg/artifacts"
+	"github.com/dmage/deepgrid/pkg/config"
+	"github.com/dmage/deepgrid/pkg/signature"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+// loadTestOutput returns the output of a stored test result.
+func loadTestOutput(ctx context.Context, conn querier, job, buildID, suite, test string, attempt int) (string, error) {
+	var output string
+	err := conn.QueryRow(
+		ctx,
+		`select coalesce(o.output, '') from test_results tr
+		left join outputs o on o.hash = tr.output_hash
+		where tr.job = $1 and tr.build_id = $2 and tr.suite = $3 and tr.test = $4 and tr.attempt = $5`,
+		job, buildID, suite, test, attempt,
+	).Scan(&output)
+	return output, err
+}
+
+// loadSampleOutputs returns the outputs of up to limit of the most recent
+// failed and flaky test results of jobs that match the regular expression
+// job.
+func loadSampleOutputs(ctx context.Context, conn querier, job string, limit int) ([]string, error) {
+	rows, err := conn.Query(
+		ctx,
+		`select o.output from test_results tr
+		join outputs o on o.hash = tr.output_hash
+		where tr.job ~ $1 and tr.status in ($2, $3)
+		order by tr.finished_timestamp desc
+		limit $4`,
+		job, artifacts.TestStatusFailure, artifacts.TestStatusFlake, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var outputs []string
+	for rows.Next() {
+		var output string
+		err = rows.Scan(&output)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, rows.Err()
+}
+
+// signatureChange describes a signature that was produced by one rule set
+// from outputs that got several different signatures from the other one.
+type signatureChange struct {
+	Signature string
+	Outputs   int
+
+	// Others maps the signatures of the other rule set to the number of
+	// outputs.
+	Others map[string]int
+}
+
+type signatureDiff struct {
+	Outputs       int
+	Changed       int
+	OldSignatures int
+	NewSignatures int
+
+	// Merges are new signatures that cover several old ones, Splits are old
+	// signatures that are divided into several new ones.
+	Merges []*signatureChange
+	Splits []*signatureChange
+}
+
+// groupSignatures returns the changes for signatures in from that map to
+// more than one signature in to.
+func groupSignatures(from, to []string) []*signatureChange {
+	changes := map[string]*signatureChange{}
+	for i, sig := range from {
+		c, ok := changes[sig]
+		if !ok {
+			c = &signatureChange{Signature: sig, Others: map[string]int{}}
+			changes[sig] = c
+		}
+		c.Outputs++
+		c.Others[to[i]]++
+	}
+
+	var result []*signatureChange
+	for _, c := range changes {
+		if len(c.Others) > 1 {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Outputs != result[j].Outputs {
+			return result[i].Outputs > result[j].Outputs
+		}
+		return result[i].Signature < result[j].Signature
+	})
+	return result
+}
+
+func countDistinct(values []string) int {
+	seen := map[string]bool{}
+	for _, v := range values {
+		seen[v] = true
+	}
+	return len(seen)
+}
+
+// diffSignatures compares the signatures that oldRules and newRules generate
+// for outputs.
+func diffSignatures(outputs []string, oldRules, newRules *signature.Rules) *signatureDiff {
+	oldSigs := make([]string, len(outputs))
+	newSigs := make([]string, len(outputs))
+	d := &signatureDiff{Outputs: len(outputs)}
+	for i, output := range outputs {
+		oldSigs[i] = oldRules.Generate(output)
+		newSigs[i] = newRules.Generate(output)
+		if oldSigs[i] != newSigs[i] {
+			d.Changed++
+		}
+	}
+	d.OldSignatures = countDistinct(oldSigs)
+	d.NewSignatures = countDistinct(newSigs)
+	d.Merges = groupSignatures(newSigs, oldSigs)
+	d.Splits = groupSignatures(oldSigs, newSigs)
+	return d
+}
+
+// indent prefixes every line of s with prefix. Empty signatures are shown
+// as (empty).
+func indent(s, prefix string) string {
+	if s == "" {
+		s = "(empty)"
+	}
+	return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix)
+}
+
+func printSignatureChanges(w io.Writer, title, otherTitle string, changes []*signatureChange) {
+	fmt.Fprintf(w, "%s: %d\n", title, len(changes))
+	for _, c := range changes {
+		fmt.Fprintf(w, "\n%d outputs with the signature\n%s\n", c.Outputs, indent(c.Signature, "    "))
+		var others []string
+		for sig := range c.Others {
+			others = append(others, sig)
+		}
+		sort.Slice(others, func(i, j int) bool {
+			if c.Others[others[i]] != c.Others[others[j]] {
+				return c.Others[others[i]] > c.Others[others[j]]
+			}
+			return others[i] < others[j]
+		})
+		fmt.Fprintf(w, "  %s:\n", otherTitle)
+		for _, sig := range others {
+			fmt.Fprintf(w, "  - %d outputs\n%s\n", c.Others[sig], indent(sig, "      "))
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// jobSignatureRules returns the rules of the test group job, or the global
+// rules if there is no such test group.
+func jobSignatureRules(cfg *config.Config, job string) *signature.Rules {
+	for _, tg := range cfg.TestGroups {
+		if tg.Name == job {
+			return tg.Signature
+		}
+	}
+	return cfg.Signature
+}
+
+var signatureOpts struct {
+	rules string
+
+	job     string
+	buildID string
+	suite   string
+	test    string
+	attempt int
+	errors  bool
+
+	old    string
+	sample int
+}
+
+func init() {
+	rootCmd.AddCommand(signatureCmd)
+	signatureCmd.AddCommand(signatureExplainCmd)
+	signatureCmd.AddCommand(signatureDiffCmd)
+
+	signatureExplainCmd.Flags().StringVar(&signatureOpts.rules, "rules", "", "file with signature rules (default: the rules of the test group --job from config.yaml)")
+	signatureExplainCmd.Flags().StringVar(&signatureOpts.job, "job", "", "job of the stored test result")
+	signatureExplainCmd.Flags().StringVar(&signatureOpts.buildID, "build", "", "build ID of the stored test result")
+	signatureExplainCmd.Flags().StringVar(&signatureOpts.suite, "suite", "", "suite of the stored test result")
+	signatureExplainCmd.Flags().StringVar(&signatureOpts.test, "test", "", "name of the stored test result")
+	signatureExplainCmd.Flags().IntVar(&signatureOpts.attempt, "attempt", 0, "attempt of the stored test result (0 is the last attempt, -1 is the one before it, ...)")
+	signatureExplainCmd.Flags().BoolVar(&signatureOpts.errors, "errors", false, "show only lines that match error patterns")
+
+	signatureDiffCmd.Flags().StringVar(&signatureOpts.old, "old", "", "file with the signature rules to compare with (default: the global rules from config.yaml)")
+	signatureDiffCmd.Flags().StringVar(&signatureOpts.job, "job", "", "regular expression for job names")
+	signatureDiffCmd.Flags().IntVar(&signatureOpts.sample, "sample", 1000, "number of the most recent failed and flaky test results to compare")
+}
+
+var signatureCmd = &cobra.Command{
+	Use:   "signature",
+	Short: "Preview signatures and compare signature rules",
+	Long: `Preview signatures and compare signature rules.
+
+Rules files have the same format as the signature section of config.yaml.`,
+}
+
+var signatureExplainCmd = &cobra.Command{
+	Use:   "explain [FILE]",
+	Short: "Show how the signature of an output is generated",
+	Long: `Show how the signature of an output is generated.
+
+The output is read from FILE, from the standard input if FILE is - or not
+set, or from the database if --job, --build and --test are set. Every line is
+printed after denoising together with the denoise rules that changed it and the
+error or exclude pattern that matched it.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		var rules *signature.Rules
+		if signatureOpts.rules != "" {
+			var err error
+			rules, err = config.LoadSignatureRules(signatureOpts.rules)
+			if err != nil {
+				klog.Exit(err)
+			}
+		} else {
+			cfg, err := config.LoadFromFile("./config.yaml")
+			if err != nil {
+				klog.Fatal(err)
+			}
+			rules = jobSignatureRules(cfg, signatureOpts.job)
+		}
+
+		var output string
+		switch {
+		case signatureOpts.job != "" || signatureOpts.buildID != "" || signatureOpts.test != "":
+			if len(args) != 0 || signatureOpts.job == "" || signatureOpts.buildID == "" || signatureOpts.test == "" {
+				klog.Exitf("--job, --build and --test must be set together and can't be used with FILE")
+			}
+			conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+			if err != nil {
+				klog.Exitf("Unable to connect to database: %s", err)
+			}
+			defer conn.Close(ctx)
+
+			output, err = loadTestOutput(ctx, conn, signatureOpts.job, signatureOpts.buildID, signatureOpts.suite, signatureOpts.test, signatureOpts.attempt)
+			if err == pgx.ErrNoRows {
+				klog.Exitf("Test result not found")
+			} else if err != nil {
+				klog.Exit(err)
+			}
+		case len(args) == 0 || args[0] == "-":
+			buf, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				klog.Exit(err)
+			}
+			output = string(buf)
+		default:
+			buf, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				klog.Exit(err)
+			}
+			output = string(buf)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "MATCH\tDENOISE\tLINE")
+		for _, t := range rules.Trace(output) {
+			if signatureOpts.errors && t.ErrorLine == "" {
+				continue
+			}
+			match := "-"
+			if t.IsErrorLine {
+				match = "error:" + t.ErrorLine
+			} else if t.ExcludeLine != "" {
+				match = "exclude:" + t.ExcludeLine
+			}
+			denoise := "-"
+			if len(t.Denoise) != 0 {
+				denoise = strings.Join(t.Denoise, ",")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", match, denoise, t.Denoised)
+		}
+		w.Flush()
+
+		fmt.Printf("\nSignature (version %d):\n%s\n", rules.Version, indent(rules.Generate(output), "    "))
+	},
+}
+
+var signatureDiffCmd = &cobra.Command{
+	Use:   "diff RULES",
+	Short: "Compare signatures generated by two rule sets",
+	Long: `Compare the signatures that two rule sets generate for a sample of stored
+outputs.
+
+The rules from the file RULES are compared with the rules from --old or, if
+it's not set, with the global rules from config.yaml. Merges are new
+signatures that cover outputs with several old signatures, splits are old
+signatures whose outputs get several new signatures.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		if signatureOpts.sample < 1 {
+			klog.Exitf("--sample must be positive")
+		}
+
+		newRules, err := config.LoadSignatureRules(args[0])
+		if err != nil {
+			klog.Exit(err)
+		}
+
+		var oldRules *signature.Rules
+		if signatureOpts.old != "" {
+			oldRules, err = config.LoadSignatureRules(signatureOpts.old)
+			if err != nil {
+				klog.Exit(err)
+			}
+		} else {
+			cfg, err := config.LoadFromFile("./config.yaml")
+			if err != nil {
+				klog.Fatal(err)
+			}
+			oldRules = cfg.Signature
+		}
+
+		conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+		if err != nil {
+			klog.Exitf("Unable to connect to database: %s", err)
+		}
+		defer conn.Close(ctx)
+
+		outputs, err := loadSampleOutputs(ctx, conn, signatureOpts.job, signatureOpts.sample)
+		if err != nil {
+			klog.Exit(err)
+		}
+
+		d := diffSignatures(outputs, oldRules, newRules)
+		fmt.Printf("Outputs: %d, changed signatures: %d\n", d.Outputs, d.Changed)
+		fmt.Printf("Distinct signatures: %d old, %d new\n\n", d.OldSignatures, d.NewSignatures)
+		printSignatureChanges(os.Stdout, "Merges", "old signatures", d.Merges)
+		printSignatureChanges(os.Stdout, "Splits", "new signatures", d.Splits)
+	},
+}
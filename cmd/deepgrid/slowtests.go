@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dmage/deepgrid/pkg/artifacts"
+	"github.com/dmage/deepgrid/pkg/stats"
+	"github.com/jackc/pgx/v4"
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+type testKey struct {
+	Job   string
+	Suite string
+	Test  string
+}
+
+// testDurations holds the durations (in milliseconds) of successful runs of
+// a test in the baseline and the recent windows.
+type testDurations struct {
+	Baseline []float64
+	Recent   []float64
+}
+
+// loadTestDurations returns the durations of successful test results for
+// jobs that match the regular expression job. Results that finished before
+// recentAfter belong to the baseline window.
+func loadTestDurations(ctx context.Context, conn querier, job string, baselineAfter, recentAfter int64) (map[testKey]*testDurations, error) {
+	rows, err := conn.Query(
+		ctx,
+		`select job, suite, test, finished_timestamp, duration_ms from test_results
+		where job ~ $1 and finished_timestamp > $2 and status = $3 and duration_ms is not null`,
+		job, baselineAfter, artifacts.TestStatusSuccess,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	durations := map[testKey]*testDurations{}
+	for rows.Next() {
+		var key testKey
+		var finishedTimestamp, durationMs int64
+		err = rows.Scan(&key.Job, &key.Suite, &key.Test, &finishedTimestamp, &durationMs)
+		if err != nil {
+			return nil, err
+		}
+		d, ok := durations[key]
+		if !ok {
+			d = &testDurations{}
+			durations[key] = d
+		}
+		if finishedTimestamp > recentAfter {
+			d.Recent = append(d.Recent, float64(durationMs))
+		} else {
+			d.Baseline = append(d.Baseline, float64(durationMs))
+		}
+	}
+	return durations, rows.Err()
+}
+
+type slowTest struct {
+	testKey
+	BaselineP50 float64
+	RecentP50   float64
+	RecentP90   float64
+	Ratio       float64
+	PValue      float64
+}
+
+// detectSlowTests returns tests whose durations in the recent window are
+// significantly bigger than in the baseline window, sorted by the ratio of
+// medians.
+func detectSlowTests(durations map[testKey]*testDurations, minSamples int, maxPValue float64, minRatio float64) []*slowTest {
+	var slowTests []*slowTest
+	for key, d := range durations {
+		if len(d.Baseline) < minSamples || len(d.Recent) < minSamples {
+			continue
+		}
+		z, p := stats.MannWhitneyU(d.Recent, d.Baseline)
+		if z <= 0 || p > maxPValue {
+			continue
+		}
+		baselineP50 := stats.Percentile(d.Baseline, 0.5)
+		recentP50 := stats.Percentile(d.Recent, 0.5)
+		// Tests that take no time can't become meaningfully slower.
+		if baselineP50 == 0 || recentP50/baselineP50 < minRatio {
+			continue
+		}
+		slowTests = append(slowTests, &slowTest{
+			testKey:     key,
+			BaselineP50: baselineP50,
+			RecentP50:   recentP50,
+			RecentP90:   stats.Percentile(d.Recent, 0.9),
+			Ratio:       recentP50 / baselineP50,
+			PValue:      p,
+		})
+	}
+	sort.Slice(slowTests, func(i, j int) bool {
+		if slowTests[i].Ratio != slowTests[j].Ratio {
+			return slowTests[i].Ratio > slowTests[j].Ratio
+		}
+		if slowTests[i].Job != slowTests[j].Job {
+			return slowTests[i].Job < slowTests[j].Job
+		}
+		if slowTests[i].Suite != slowTests[j].Suite {
+			return slowTests[i].Suite < slowTests[j].Suite
+		}
+		return slowTests[i].Test < slowTests[j].Test
+	})
+	return slowTests
+}
+
+func formatMilliseconds(ms float64) string {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Millisecond).String()
+}
+
+var slowTestsOpts struct {
+	job        string
+	window     time.Duration
+	minSamples int
+	pValue     float64
+	minRatio   float64
+}
+
+func init() {
+	rootCmd.AddCommand(slowTestsCmd)
+
+	slowTestsCmd.Flags().StringVar(&slowTestsOpts.job, "job", "", "regular expression for job names")
+	slowTestsCmd.Flags().DurationVar(&slowTestsOpts.window, "window", 7*24*time.Hour, "length of the recent window; the baseline window is the same length and directly precedes it")
+	slowTestsCmd.Flags().IntVar(&slowTestsOpts.minSamples, "min-samples", 10, "minimum number of successful runs in each window")
+	slowTestsCmd.Flags().Float64Var(&slowTestsOpts.pValue, "p-value", 0.01, "maximum p-value of the Mann-Whitney U test")
+	slowTestsCmd.Flags().Float64Var(&slowTestsOpts.minRatio, "min-ratio", 1.2, "minimum ratio of the recent median duration to the baseline median duration")
+}
+
+var slowTestsCmd = &cobra.Command{
+	Use:   "slowtests",
+	Short: "Find tests that became slower",
+	Long: `Find tests whose durations shifted significantly between two time windows.
+
+Durations of successful runs in the recent window are compared with the
+preceding window of the same length using the Mann-Whitney U test.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+
+		if slowTestsOpts.window <= 0 {
+			klog.Exitf("--window must be positive")
+		}
+
+		conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+		if err != nil {
+			klog.Exitf("Unable to connect to database: %s", err)
+		}
+		defer conn.Close(ctx)
+
+		now := time.Now()
+		recentAfter := now.Add(-slowTestsOpts.window).Unix()
+		baselineAfter := now.Add(-2 * slowTestsOpts.window).Unix()
+
+		durations, err := loadTestDurations(ctx, conn, slowTestsOpts.job, baselineAfter, recentAfter)
+		if err != nil {
+			klog.Exit(err)
+		}
+
+		slowTests := detectSlowTests(durations, slowTestsOpts.minSamples, slowTestsOpts.pValue, slowTestsOpts.minRatio)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "JOB\tSUITE\tTEST\tBASELINE P50\tRECENT P50\tRECENT P90\tRATIO\tP-VALUE")
+		for _, t := range slowTests {
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%s\t%s\t%s\t%.2f\t%.2g\n",
+				t.Job, t.Suite, t.Test,
+				formatMilliseconds(t.BaselineP50),
+				formatMilliseconds(t.RecentP50),
+				formatMilliseconds(t.RecentP90),
+				t.Ratio, t.PValue,
+			)
+		}
+		w.Flush()
+	},
+}
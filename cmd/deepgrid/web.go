@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -32,6 +34,158 @@ type ColumnInfo struct {
 	Title string
 	Field string
 	Query string
+
+	// Expr is the SQL expression for the column.
+	Expr string
+
+	// NeedsBuild is true if Expr refers to the build_statuses table.
+	NeedsBuild bool
+
+	// NeedsCluster is true if Expr refers to the signature_clusters table.
+	NeedsCluster bool
+}
+
+// metadataPrefix is the prefix of columns and filters for build metadata,
+// e.g. meta.release=^4\.7 filters builds by the metadata key release.
+const metadataPrefix = "meta."
+
+var columnInfos = map[string]*ColumnInfo{
+	"job": {
+		Title: "Job",
+		Field: "Job",
+		Query: "job",
+		Expr:  "tr.job",
+	},
+	"build_id": {
+		Title: "Build ID",
+		Field: "BuildID",
+		Query: "build_id",
+		Expr:  "tr.build_id",
+	},
+	"suite": {
+		Title: "Suite",
+		Field: "Suite",
+		Query: "suite",
+		Expr:  "tr.suite",
+	},
+	"test": {
+		Title: "Test",
+		Field: "Test",
+		Query: "test",
+		Expr:  "tr.test",
+	},
+	"signature": {
+		Title: "Signature",
+		Field: "Signature",
+		Query: "signature",
+		Expr:  "tr.signature",
+	},
+	"cluster": {
+		Title:        "Cluster",
+		Field:        "Cluster",
+		Query:        "cluster",
+		Expr:         "COALESCE(sc.cluster_id::text, '')",
+		NeedsCluster: true,
+	},
+	"fingerprint": {
+		Title: "Failure Location",
+		Field: "Fingerprint",
+		Query: "fingerprint",
+		Expr:  "COALESCE(tr.fingerprint, '')",
+	},
+	"repo": {
+		Title:      "Repository",
+		Field:      "Repo",
+		Query:      "repo",
+		Expr:       "COALESCE(bs.repo, '')",
+		NeedsBuild: true,
+	},
+	"pull": {
+		Title:      "Pull Request",
+		Field:      "Pull",
+		Query:      "pull",
+		Expr:       "COALESCE(bs.pull_number::text, '')",
+		NeedsBuild: true,
+	},
+}
+
+// durationPercentiles are the percentiles of durations that are shown for
+// every row.
+var durationPercentiles = []string{"0.5", "0.9", "0.99"}
+
+// testDurationPercentile returns the SQL expression for the p-th percentile
+// of durations of successful test results in milliseconds. Failed tests are
+// skipped, as they often time out.
+func testDurationPercentile(p string) string {
+	return "percentile_cont(" + p + ") WITHIN GROUP (ORDER BY tr.duration_ms) FILTER (WHERE tr.status = 5)"
+}
+
+// buildDurationPercentile returns the SQL expression for the p-th percentile
+// of build durations in seconds. It should be used in a query where every
+// build is a single row of build_statuses bs.
+func buildDurationPercentile(p string) string {
+	return "percentile_cont(" + p + ") WITHIN GROUP (ORDER BY bs.finished_timestamp - bs.started_timestamp)"
+}
+
+// formatDuration formats a percentile that is returned by the database. v is
+// nil if there were no durations.
+func formatDuration(v *float64, unit time.Duration) string {
+	if v == nil {
+		return ""
+	}
+	d := time.Duration(*v * float64(unit))
+	if d >= time.Minute {
+		return d.Round(time.Second).String()
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+// clusterMember is a signature of a cluster with the statistics of its
+// failed and flaky test results.
+type clusterMember struct {
+	Signature string
+	Failures  int
+	Flakes    int
+	Tests     int
+	Jobs      int
+	LastSeen  time.Time
+}
+
+// loadClusterMembers returns the signatures of the cluster id, the most
+// frequent ones first.
+func loadClusterMembers(ctx context.Context, conn querier, id int64) ([]*clusterMember, error) {
+	rows, err := conn.Query(
+		ctx,
+		`SELECT sc.signature,
+			COUNT(*) FILTER (WHERE tr.status = 3),
+			COUNT(*) FILTER (WHERE tr.status = 4),
+			COUNT(DISTINCT tr.test),
+			COUNT(DISTINCT tr.job),
+			COALESCE(MAX(tr.finished_timestamp), 0)
+		FROM signature_clusters sc
+		LEFT JOIN test_results tr ON tr.signature = sc.signature AND tr.status IN (3, 4)
+		WHERE sc.cluster_id = $1
+		GROUP BY sc.signature
+		ORDER BY 2 DESC, 3 DESC, 1`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []*clusterMember
+	for rows.Next() {
+		m := &clusterMember{}
+		var lastSeen int64
+		err = rows.Scan(&m.Signature, &m.Failures, &m.Flakes, &m.Tests, &m.Jobs, &lastSeen)
+		if err != nil {
+			return nil, err
+		}
+		m.LastSeen = time.Unix(lastSeen, 0).UTC()
+		members = append(members, m)
+	}
+	return members, rows.Err()
 }
 
 var templateFuncs = template.FuncMap{
@@ -73,48 +227,21 @@ var webCmd = &cobra.Command{
 
 			startTime := time.Now()
 
-			columnsRaw := r.URL.Query().Get("columns")
-			var columns []*ColumnInfo
-			if columnsRaw != "" {
-				for _, col := range strings.Split(columnsRaw, ",") {
-					switch col {
-					case "job":
-						columns = append(columns, &ColumnInfo{
-							Title: "Job",
-							Field: "Job",
-							Query: col,
-						})
-					case "build_id":
-						columns = append(columns, &ColumnInfo{
-							Title: "Build ID",
-							Field: "BuildID",
-							Query: col,
-						})
-					case "test":
-						columns = append(columns, &ColumnInfo{
-							Title: "Test",
-							Field: "Test",
-							Query: col,
-						})
-					case "signature":
-						columns = append(columns, &ColumnInfo{
-							Title: "Signature",
-							Field: "Signature",
-							Query: col,
-						})
-					default:
-						panic("FIXME")
-					}
-				}
-			}
-
 			job := r.URL.Query().Get("job")
+			suite := r.URL.Query().Get("suite")
+			fingerprint := r.URL.Query().Get("fingerprint")
+			clusterID := r.URL.Query().Get("cluster")
 			test := r.URL.Query().Get("test")
 			output := r.URL.Query().Get("output")
 			signature := strings.ReplaceAll(r.URL.Query().Get("signature"), "\x0d", "")
 			count := r.URL.Query().Get("count")
 			order := r.URL.Query().Get("order")
 			age := r.URL.Query().Get("age")
+			repo := r.URL.Query().Get("repo")
+			pull := r.URL.Query().Get("pull")
+			metaColumn := r.URL.Query().Get("meta_column")
+			metaKey := r.URL.Query().Get("meta_key")
+			metaValue := r.URL.Query().Get("meta_value")
 
 			finishedAfter := int64(0)
 			if age != "" {
@@ -125,56 +252,188 @@ var webCmd = &cobra.Command{
 				finishedAfter = time.Now().Unix() - int64(i)
 			}
 
-			var groupByFields []string
-			var sqlSelect []string
-			for _, col := range columns {
-				sqlSelect = append(sqlSelect, "tr."+col.Query)
-				groupByFields = append(groupByFields, "tr."+col.Query)
+			sqlArgs := []interface{}{job, test, output, signature, finishedAfter}
+			sqlWhere := []string{"tr.job ~ $1", "tr.test ~ $2", "tr.signature ~ $4", "tr.finished_timestamp > $5"}
+			// Outputs are stored in a separate table, see saveOutputs.
+			sqlJoins := []string{"LEFT JOIN outputs o ON o.hash = tr.output_hash"}
+			needsBuild := false
+			needsCluster := false
+
+			// joinMetadata joins the build_metadata table for the given key
+			// and returns the expression for its value.
+			joinMetadata := func(key string) string {
+				sqlArgs = append(sqlArgs, key)
+				alias := fmt.Sprintf("bm%d", len(sqlJoins))
+				sqlJoins = append(sqlJoins, fmt.Sprintf("LEFT JOIN build_metadata %[1]s ON %[1]s.job = tr.job AND %[1]s.build_id = tr.build_id AND %[1]s.key = $%[2]d", alias, len(sqlArgs)))
+				return "COALESCE(" + alias + ".value, '')"
+			}
+
+			columnsRaw := r.URL.Query().Get("columns")
+			var columnNames []string
+			if columnsRaw != "" {
+				columnNames = strings.Split(columnsRaw, ",")
+			}
+			if metaColumn != "" {
+				columnNames = append(columnNames, metadataPrefix+metaColumn)
+			}
+			var columns []*ColumnInfo
+			for _, col := range columnNames {
+				if strings.HasPrefix(col, metadataPrefix) {
+					key := strings.TrimPrefix(col, metadataPrefix)
+					columns = append(columns, &ColumnInfo{
+						Title: key,
+						Field: col,
+						Query: col,
+						Expr:  joinMetadata(key),
+					})
+					continue
+				}
+				info, ok := columnInfos[col]
+				if !ok {
+					http.Error(w, fmt.Sprintf("unknown column %q", col), http.StatusBadRequest)
+					return
+				}
+				columns = append(columns, info)
+				needsBuild = needsBuild || info.NeedsBuild
+				needsCluster = needsCluster || info.NeedsCluster
+			}
+
+			addFilter := func(expr, value string) {
+				sqlArgs = append(sqlArgs, value)
+				sqlWhere = append(sqlWhere, fmt.Sprintf("%s ~ $%d", expr, len(sqlArgs)))
+			}
+			if suite != "" {
+				addFilter(columnInfos["suite"].Expr, suite)
+			}
+			if fingerprint != "" {
+				addFilter(columnInfos["fingerprint"].Expr, fingerprint)
+			}
+			if clusterID != "" {
+				addFilter(columnInfos["cluster"].Expr, clusterID)
+				needsCluster = true
+			}
+			if repo != "" {
+				addFilter(columnInfos["repo"].Expr, repo)
+				needsBuild = true
+			}
+			if pull != "" {
+				addFilter(columnInfos["pull"].Expr, pull)
+				needsBuild = true
 			}
-			sqlJoin := ""
-			sqlOrderBy := ""
+			metaFilters := map[string]string{}
+			for param, values := range r.URL.Query() {
+				if strings.HasPrefix(param, metadataPrefix) && len(values) > 0 {
+					metaFilters[strings.TrimPrefix(param, metadataPrefix)] = values[0]
+				}
+			}
+			if metaKey != "" {
+				metaFilters[metaKey] = metaValue
+			}
+			var metaFilterKeys []string
+			for key := range metaFilters {
+				metaFilterKeys = append(metaFilterKeys, key)
+			}
+			sort.Strings(metaFilterKeys)
+			for _, key := range metaFilterKeys {
+				addFilter(joinMetadata(key), metaFilters[key])
+			}
+
+			if needsCluster {
+				sqlJoins = append(sqlJoins, "LEFT JOIN signature_clusters sc ON sc.signature = tr.signature")
+			}
+
+			var sqlQuery string
 			if count == "tests" {
+				var groupByFields []string
+				var sqlSelect []string
+				for _, col := range columns {
+					sqlSelect = append(sqlSelect, col.Expr)
+					groupByFields = append(groupByFields, col.Expr)
+				}
 				sqlSelect = append(
 					sqlSelect,
 					`COUNT(*)`,
 					`COUNT(*) FILTER (WHERE status = 3) AS failures`,
 					`COUNT(*) FILTER (WHERE status = 4) AS flakes`,
 					`COUNT(*) FILTER (WHERE status = 5) AS successes`,
-					`COUNT(*) FILTER (WHERE status = 3 AND output ~ $3) AS failures_matches`,
-					`COUNT(*) FILTER (WHERE status = 4 AND output ~ $3) AS flakes_matches`,
-					`COUNT(*) FILTER (WHERE status = 5 AND output ~ $3) AS successes_matches`,
+					`COUNT(*) FILTER (WHERE status = 3 AND COALESCE(o.output, '') ~ $3) AS failures_matches`,
+					`COUNT(*) FILTER (WHERE status = 4 AND COALESCE(o.output, '') ~ $3) AS flakes_matches`,
+					`COUNT(*) FILTER (WHERE status = 5 AND COALESCE(o.output, '') ~ $3) AS successes_matches`,
 					`COUNT(DISTINCT tr.signature) FILTER (WHERE status = 3 OR status = 4) AS signatures`,
 				)
-				sqlOrderBy = "failures DESC, flakes DESC, successes DESC"
+				for _, p := range durationPercentiles {
+					sqlSelect = append(sqlSelect, testDurationPercentile(p))
+				}
+				sqlOrderBy := "failures DESC, flakes DESC, successes DESC"
+				if order == "timestamp" {
+					sqlOrderBy = "MAX(tr.finished_timestamp) DESC"
+				}
+				if needsBuild {
+					sqlJoins = append(sqlJoins, "JOIN build_statuses bs ON bs.job = tr.job AND bs.build_id = tr.build_id")
+				}
+				sqlGroupBy := ""
+				if len(groupByFields) > 0 {
+					sqlGroupBy = "GROUP BY " + strings.Join(groupByFields, ", ") + " HAVING COUNT(*) FILTER (WHERE COALESCE(o.output, '') ~ $3) > 0"
+				}
+				sqlQuery = `
+					SELECT ` + strings.Join(sqlSelect, ",") + `
+					FROM test_results tr
+					` + strings.Join(sqlJoins, "\n") + `
+					WHERE ` + strings.Join(sqlWhere, " AND ") + `
+					` + sqlGroupBy + `
+					ORDER BY ` + sqlOrderBy + `
+					LIMIT 50
+				`
 			} else {
-				sqlCount := "DISTINCT CONCAT(tr.job, '/', tr.build_id)"
-				sqlSelect = append(
-					sqlSelect,
-					`COUNT(`+sqlCount+`)`,
-					`COUNT(`+sqlCount+`) FILTER (WHERE bs.result = 'FAILURE') AS failures`,
-					`COUNT(`+sqlCount+`) FILTER (WHERE bs.result = 'SUCCESS') AS successes`,
-					`COUNT(`+sqlCount+`) FILTER (WHERE output ~ $3)`,
+				// Test results are aggregated by build first, so that every
+				// build is counted once and its duration is taken once.
+				innerSelect := []string{"tr.job", "tr.build_id", "MAX(tr.finished_timestamp) AS finished_timestamp", "bool_or(COALESCE(o.output, '') ~ $3) AS matches"}
+				innerGroupBy := []string{"tr.job", "tr.build_id"}
+				var outerSelect, outerGroupBy []string
+				for i, col := range columns {
+					innerSelect = append(innerSelect, fmt.Sprintf("%s AS c%d", col.Expr, i))
+					innerGroupBy = append(innerGroupBy, col.Expr)
+					outerSelect = append(outerSelect, fmt.Sprintf("b.c%d", i))
+					outerGroupBy = append(outerGroupBy, fmt.Sprintf("b.c%d", i))
+				}
+				outerSelect = append(
+					outerSelect,
+					`COUNT(*)`,
+					`COUNT(*) FILTER (WHERE bs.result = 'FAILURE') AS failures`,
+					`COUNT(*) FILTER (WHERE bs.result = 'SUCCESS') AS successes`,
+					`COUNT(*) FILTER (WHERE b.matches)`,
 				)
-				sqlJoin = "JOIN build_statuses bs ON bs.job = tr.job AND bs.build_id = tr.build_id"
-				sqlOrderBy = "failures DESC, successes DESC"
-			}
-			sqlGroupBy := ""
-			if len(groupByFields) > 0 {
-				sqlGroupBy = "GROUP BY " + strings.Join(groupByFields, ", ") + " HAVING COUNT(*) FILTER (WHERE output ~ $3) > 0"
-			}
-			if order == "timestamp" {
-				sqlOrderBy = "MAX(finished_timestamp) DESC"
+				for _, p := range durationPercentiles {
+					outerSelect = append(outerSelect, buildDurationPercentile(p))
+				}
+				sqlOrderBy := "failures DESC, successes DESC"
+				if order == "timestamp" {
+					sqlOrderBy = "MAX(b.finished_timestamp) DESC"
+				}
+				if needsBuild {
+					sqlJoins = append(sqlJoins, "JOIN build_statuses bs ON bs.job = tr.job AND bs.build_id = tr.build_id")
+				}
+				sqlGroupBy := ""
+				if len(outerGroupBy) > 0 {
+					sqlGroupBy = "GROUP BY " + strings.Join(outerGroupBy, ", ") + " HAVING COUNT(*) FILTER (WHERE b.matches) > 0"
+				}
+				sqlQuery = `
+					SELECT ` + strings.Join(outerSelect, ",") + `
+					FROM (
+						SELECT ` + strings.Join(innerSelect, ",") + `
+						FROM test_results tr
+						` + strings.Join(sqlJoins, "\n") + `
+						WHERE ` + strings.Join(sqlWhere, " AND ") + `
+						GROUP BY ` + strings.Join(innerGroupBy, ", ") + `
+					) b
+					JOIN build_statuses bs ON bs.job = b.job AND bs.build_id = b.build_id
+					` + sqlGroupBy + `
+					ORDER BY ` + sqlOrderBy + `
+					LIMIT 50
+				`
 			}
 
-			rows, err := conn.Query(ctx, `
-				SELECT `+strings.Join(sqlSelect, ",")+`
-				FROM test_results tr
-				`+sqlJoin+`
-				WHERE tr.job ~ $1 AND tr.test ~ $2 AND tr.signature ~ $4 AND tr.finished_timestamp > $5
-				`+sqlGroupBy+`
-				ORDER BY `+sqlOrderBy+`
-				LIMIT 50
-			`, job, test, output, signature, finishedAfter)
+			rows, err := conn.Query(ctx, sqlQuery, sqlArgs...)
 			if err != nil {
 				klog.Errorf("%s", err)
 				return
@@ -183,38 +442,29 @@ var webCmd = &cobra.Command{
 
 			var data = []map[string]interface{}{}
 			for rows.Next() {
-				var job, buildID, test, signature string
+				values := make([]string, len(columns))
 				var total, failures, flakes, successes, failuresMatches, flakesMatches, successesMatches, signatures, matches int
+				percentiles := make([]*float64, len(durationPercentiles))
 				var dest []interface{}
-				for _, col := range columns {
-					switch col.Query {
-					case "job":
-						dest = append(dest, &job)
-					case "build_id":
-						dest = append(dest, &buildID)
-					case "test":
-						dest = append(dest, &test)
-					case "signature":
-						dest = append(dest, &signature)
-					default:
-						panic("FIXME")
-					}
+				for i := range columns {
+					dest = append(dest, &values[i])
 				}
 				if count == "tests" {
 					dest = append(dest, &total, &failures, &flakes, &successes, &failuresMatches, &flakesMatches, &successesMatches, &signatures)
 				} else {
 					dest = append(dest, &total, &failures, &successes, &matches)
 				}
+				for i := range percentiles {
+					dest = append(dest, &percentiles[i])
+				}
 				err = rows.Scan(dest...)
 				if err != nil {
 					klog.Errorf("%s", err)
 					return
 				}
-				d := map[string]interface{}{
-					"Job":       job,
-					"BuildID":   buildID,
-					"Test":      test,
-					"Signature": signature,
+				d := map[string]interface{}{}
+				for i, col := range columns {
+					d[col.Field] = values[i]
 				}
 				if count == "tests" {
 					d["Total"] = total
@@ -231,6 +481,17 @@ var webCmd = &cobra.Command{
 					d["Successes"] = successes
 					d["Matches"] = matches
 				}
+				// Test durations are stored in milliseconds, build durations
+				// are computed from timestamps in seconds.
+				unit := time.Second
+				if count == "tests" {
+					unit = time.Millisecond
+				}
+				var durations []string
+				for _, p := range percentiles {
+					durations = append(durations, formatDuration(p, unit))
+				}
+				d["Durations"] = durations
 				data = append(data, d)
 			}
 			if rows.Err() != nil {
@@ -242,14 +503,22 @@ var webCmd = &cobra.Command{
 
 			err = t.ExecuteTemplate(w, "index.html", map[string]interface{}{
 				"Query": map[string]string{
-					"Columns":   columnsRaw,
-					"Job":       job,
-					"Test":      test,
-					"Output":    output,
-					"Signature": signature,
-					"Count":     count,
-					"Order":     order,
-					"Age":       age,
+					"Columns":     columnsRaw,
+					"Job":         job,
+					"Suite":       suite,
+					"Fingerprint": fingerprint,
+					"Cluster":     clusterID,
+					"Test":        test,
+					"Output":      output,
+					"Signature":   signature,
+					"Count":       count,
+					"Order":       order,
+					"Age":         age,
+					"Repo":        repo,
+					"Pull":        pull,
+					"MetaColumn":  metaColumn,
+					"MetaKey":     metaKey,
+					"MetaValue":   metaValue,
 				},
 				"Columns":  columns,
 				"Data":     data,
@@ -260,6 +529,36 @@ var webCmd = &cobra.Command{
 			}
 		})
 
+		http.HandleFunc("/cluster", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid cluster id", http.StatusBadRequest)
+				return
+			}
+
+			conn, err := pool.Acquire(ctx)
+			if err != nil {
+				klog.Errorf("%s", err)
+				return
+			}
+			defer conn.Release()
+
+			members, err := loadClusterMembers(ctx, conn, id)
+			if err != nil {
+				klog.Errorf("%s", err)
+				return
+			}
+
+			err = t.ExecuteTemplate(w, "cluster.html", map[string]interface{}{
+				"ID":      id,
+				"Members": members,
+			})
+			if err != nil {
+				klog.Errorf("%s", err)
+			}
+		})
+
 		klog.Info("Listening on http://localhost:8080")
 		log.Fatal(http.ListenAndServe(":8080", nil))
 	},
@@ -5,6 +5,7 @@ go 1.15
 require (
 	cloud.google.com/go/storage v1.13.0
 	github.com/GoogleCloudPlatform/testgrid v0.0.47
+	github.com/jackc/pgconn v1.8.0
 	github.com/jackc/pgx/v4 v4.10.1
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/pflag v1.0.5
@@ -15,20 +15,76 @@ CREATE TABLE build_statuses (
     build_id varchar(64),
     started_timestamp bigint,
     finished_timestamp bigint,
-    result varchar(64)
+    result varchar(64),
+    repo varchar(256),
+    pull_number int,
+    base_sha varchar(64),
+    head_sha varchar(64),
+    redactions int NOT NULL DEFAULT 0
 );
 CREATE UNIQUE INDEX build_statuses_result_idx ON build_statuses USING btree (job, build_id, result);
+CREATE INDEX build_statuses_pull_idx ON build_statuses USING btree (repo, pull_number);
+
+CREATE TABLE build_metadata (
+    job varchar(256),
+    build_id varchar(64),
+    key varchar(256),
+    value text
+);
+CREATE UNIQUE INDEX build_metadata_job_build_id_key_idx ON build_metadata USING btree (job, build_id, key);
+CREATE INDEX build_metadata_key_value_idx ON build_metadata USING btree (key, value);
 
 CREATE TABLE test_results (
     job varchar(256),
     build_id varchar(64),
+    suite varchar(1024) NOT NULL DEFAULT '',
     test varchar(1024),
     finished_timestamp bigint,
     attempt int,
     attempts int,
     status int,
-    output text,
-    signature text
+    output_hash bytea,
+    output_reduced boolean NOT NULL DEFAULT false,
+    signature text,
+    signature_version int,
+    fingerprint text,
+    duration_ms bigint,
+    properties text,
+    system_out text,
+    system_err text
+);
+CREATE UNIQUE INDEX job_build_id_suite_test_attempt_idx ON test_results USING btree (job, build_id, suite, test, attempt);
+CREATE INDEX gin_idx ON test_results USING gin (job gin_trgm_ops, test gin_trgm_ops, (status::text) gin_trgm_ops);
+CREATE INDEX test_results_output_hash_idx ON test_results USING btree (output_hash);
+CREATE INDEX test_results_signature_idx ON test_results USING hash (signature);
+CREATE INDEX test_results_fingerprint_idx ON test_results USING btree (fingerprint) WHERE fingerprint <> '';
+
+-- Outputs of test results are stored once per distinct content. The hash is
+-- the SHA-256 of the output. Large outputs are compressed by TOAST; on
+-- PostgreSQL 14+ lz4 can be used instead of pglz:
+--   ALTER TABLE outputs ALTER COLUMN output SET COMPRESSION lz4;
+CREATE TABLE outputs (
+    hash bytea PRIMARY KEY,
+    output text
+);
+CREATE INDEX outputs_output_trgm_idx ON outputs USING gin (output gin_trgm_ops);
+
+-- Clusters of similar signatures, see the cluster command. The table is
+-- rewritten by every run, the sequence holds the last assigned cluster ID.
+CREATE TABLE signature_clusters (
+    signature text,
+    cluster_id bigint
+);
+CREATE INDEX signature_clusters_signature_idx ON signature_clusters USING hash (signature);
+CREATE INDEX signature_clusters_cluster_id_idx ON signature_clusters USING btree (cluster_id);
+CREATE SEQUENCE signature_cluster_ids;
+
+CREATE TABLE index_errors (
+    job varchar(256),
+    build_id varchar(64),
+    stage varchar(64),
+    error text,
+    attempts int,
+    last_attempt bigint
 );
-CREATE UNIQUE INDEX job_build_id_test_attempt_idx ON test_results USING btree (job, build_id, test, attempt);
-CREATE INDEX gin_idx ON test_results USING gin (job gin_trgm_ops, test gin_trgm_ops, output gin_trgm_ops, (status::text) gin_trgm_ops);
+CREATE UNIQUE INDEX index_errors_job_build_id_idx ON index_errors USING btree (job, build_id);
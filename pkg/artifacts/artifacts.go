@@ -1,39 +1,72 @@
 package artifacts
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
-	"cloud.google.com/go/storage"
-	"github.com/GoogleCloudPlatform/testgrid/metadata/junit"
-	"google.golang.org/api/iterator"
 	"k8s.io/klog/v2"
 )
 
 var ErrNotFound = errors.New("not found")
 
-var junitObject = regexp.MustCompile(`/junit.*\.xml$`)
 var buildLogObject = regexp.MustCompile(`/build-log.txt$`)
 
 type Build struct {
-	Job       string
-	BuildID   string
-	GCSBucket string
-	GCSPrefix string
+	Job     string
+	BuildID string
+
+	// Scheme, Bucket and Prefix describe where the build's artifacts are
+	// stored. Prefix ends with a slash.
+	Scheme string
+	Bucket string
+	Prefix string
+
+	// Link is the name of the object in the same bucket that contains the
+	// location of the build. Such builds should be resolved by ResolveBuild
+	// before their artifacts can be accessed.
+	Link string
 }
 
 func (b Build) String() string {
-	return fmt.Sprintf("%s @ %s (gs://%s/%s)", b.Job, b.BuildID, b.GCSBucket, b.GCSPrefix)
+	if b.Link != "" {
+		return fmt.Sprintf("%s @ %s (%s://%s/%s)", b.Job, b.BuildID, b.Scheme, b.Bucket, b.Link)
+	}
+	return fmt.Sprintf("%s @ %s (%s://%s/%s)", b.Job, b.BuildID, b.Scheme, b.Bucket, b.Prefix)
+}
+
+// CompareBuildIDs returns -1, 0 or +1 depending on whether a is less than,
+// equal to or greater than b. Numeric IDs are compared as numbers, other IDs
+// are compared lexically.
+func CompareBuildIDs(a, b string) int {
+	x, errA := strconv.ParseUint(a, 10, 64)
+	y, errB := strconv.ParseUint(b, 10, 64)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
+
+// SortBuilds sorts builds by their IDs in increasing order.
+func SortBuilds(builds []*Build) {
+	sort.Slice(builds, func(i, j int) bool {
+		return CompareBuildIDs(builds[i].BuildID, builds[j].BuildID) < 0
+	})
 }
 
 type BuildMeta struct {
@@ -45,6 +78,9 @@ type BuildStatus struct {
 	StartedTimestamp  int64
 	FinishedTimestamp int64
 	Result            string
+
+	// Pull is set for presubmit builds.
+	Pull *PullRef
 }
 
 type TestStatus int
@@ -76,88 +112,181 @@ func (s TestStatus) String() string {
 	return fmt.Sprintf("TestStatus(%d)", s)
 }
 
+// SuitePathSeparator separates the names of nested JUnit suites in
+// TestResult.Suite.
+const SuitePathSeparator = "/"
+
 type TestResult struct {
+	// Suite is the path of the JUnit suite that contains the test, e.g.
+	// "e2e/conformance", or the name of the build log for ci-operator steps.
+	// It's empty for other results.
+	Suite  string
 	Test   string
 	Status TestStatus
 	Output string
+
+	// Properties, SystemOut and SystemErr are the test case's <properties>,
+	// <system-out> and <system-err> elements.
+	Properties map[string]string
+	SystemOut  string
+	SystemErr  string
+
+	// Duration is the time the test took to run. It's meaningful only if
+	// HasDuration is set.
+	Duration    time.Duration
+	HasDuration bool
+}
+
+// SortedFiles returns the names of the build's files in lexical order.
+func (m *BuildMeta) SortedFiles() []string {
+	files := make([]string, 0, len(m.Files))
+	for f := range m.Files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+type registeredStorage struct {
+	storage Storage
+	cached  bool
 }
 
 type Client struct {
-	cacheDir  string
-	gcsClient *storage.Client
+	cacheDir string
+	storages map[string]registeredStorage
+
+	// downloads limits the number of concurrent requests to storages.
+	downloads chan struct{}
+
+	resultFormats []resultFormat
+	logLimits     LogLimits
 }
 
-func NewClient(gcsClient *storage.Client) *Client {
+// NewClient returns a client that makes at most maxDownloads concurrent
+// requests to storages. Storages should be added using RegisterStorage.
+func NewClient(maxDownloads int) *Client {
 	return &Client{
-		cacheDir:  "./cache",
-		gcsClient: gcsClient,
+		cacheDir:  DefaultCacheDir,
+		storages:  map[string]registeredStorage{},
+		downloads: make(chan struct{}, maxDownloads),
 	}
 }
 
-func (c *Client) gcsListDir(ctx context.Context, bucket, prefix string) (dirs []string, files []string, err error) {
-	bkt := c.gcsClient.Bucket(bucket)
-	it := bkt.Objects(ctx, &storage.Query{
-		Delimiter: "/",
-		Prefix:    prefix,
-	})
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, nil, err
-		}
-		if attrs.Prefix == "" {
-			files = append(files, attrs.Name)
-		} else {
-			dirs = append(dirs, attrs.Prefix)
-		}
+// RegisterStorage makes the client use s for locations with the given URL
+// scheme. If cached is true, downloaded objects are stored in the cache
+// directory.
+func (c *Client) RegisterStorage(scheme string, s Storage, cached bool) {
+	c.storages[scheme] = registeredStorage{
+		storage: s,
+		cached:  cached,
 	}
-	return dirs, files, nil
 }
 
-func (c *Client) gcsListFiles(ctx context.Context, bucket, prefix string) (files []string, err error) {
-	bkt := c.gcsClient.Bucket(bucket)
-	it := bkt.Objects(ctx, &storage.Query{
-		Prefix: prefix,
-	})
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		files = append(files, attrs.Name)
+func (c *Client) storage(scheme string) (registeredStorage, error) {
+	s, ok := c.storages[scheme]
+	if !ok {
+		return s, fmt.Errorf("unsupported storage scheme %q", scheme)
+	}
+	return s, nil
+}
+
+func (c *Client) acquire(ctx context.Context) error {
+	select {
+	case c.downloads <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) release() {
+	<-c.downloads
+}
+
+func (c *Client) listDir(ctx context.Context, scheme, bucket, prefix, startOffset string) (dirs []string, files []string, err error) {
+	s, err := c.storage(scheme)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.acquire(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer c.release()
+
+	return s.storage.ListDir(ctx, bucket, prefix, startOffset)
+}
+
+func (c *Client) listFiles(ctx context.Context, scheme, bucket, prefix string) (files []string, err error) {
+	s, err := c.storage(scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	return s.storage.ListFiles(ctx, bucket, prefix)
+}
+
+// open returns a reader for the content of the object. Compressed objects are
+// decompressed on the fly.
+func (c *Client) open(ctx context.Context, scheme, bucket, object string) (io.ReadCloser, error) {
+	r, err := c.openRaw(ctx, scheme, bucket, object)
+	if err != nil {
+		return nil, err
 	}
-	return files, nil
+	return decompress(r)
 }
 
-func (c *Client) gcsOpen(ctx context.Context, bucket string, object string) (io.ReadCloser, error) {
+// openRaw returns a reader for the object as it's stored, going through the
+// cache for cached storages. Objects are stored in the cache compressed, so
+// the reader may return gzipped content for uncompressed objects.
+func (c *Client) openRaw(ctx context.Context, scheme, bucket, object string) (io.ReadCloser, error) {
+	s, err := c.storage(scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.cached {
+		return s.storage.Open(ctx, bucket, object)
+	}
+
 	// object may have /, so this code won't work on Windows
-	path := fmt.Sprintf("%s/%s/%s", c.cacheDir, bucket, object)
+	path := fmt.Sprintf("%s/%s/%s/%s", c.cacheDir, scheme, bucket, object)
 
 	f, err := os.Open(path)
 	if err == nil {
-		klog.V(4).Infof("Found gs://%s/%s in cache", bucket, object)
+		klog.V(4).Infof("Found %s://%s/%s in cache", scheme, bucket, object)
+		// The modification time is used by PruneCache to find the least
+		// recently used files.
+		now := time.Now()
+		_ = os.Chtimes(path, now, now)
 		return f, nil
 	}
 	if !os.IsNotExist(err) {
 		return nil, err
 	}
-	klog.V(4).Infof("Downloading gs://%s/%s...", bucket, object)
+
+	err = c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	klog.V(4).Infof("Downloading %s://%s/%s...", scheme, bucket, object)
 
 	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 
-	bkt := c.gcsClient.Bucket(bucket)
-	r, err := bkt.Object(object).NewReader(ctx)
+	r, err := s.storage.Open(ctx, bucket, object)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open gs://%s/%s: %w", bucket, object, err)
+		return nil, err
 	}
 	defer r.Close()
 
@@ -166,7 +295,7 @@ func (c *Client) gcsOpen(ctx context.Context, bucket string, object string) (io.
 		return nil, err
 	}
 
-	_, err = io.Copy(f, r)
+	err = compress(f, r)
 	if err != nil {
 		// Best effort cleanup
 		_ = f.Close()
@@ -187,43 +316,71 @@ func (c *Client) gcsOpen(ctx context.Context, bucket string, object string) (io.
 	return os.Open(path)
 }
 
-func (c *Client) FindBuilds(ctx context.Context, name, gcsBucketPrefix string) ([]*Build, error) {
-	if !strings.HasSuffix(gcsBucketPrefix, "/") {
-		gcsBucketPrefix += "/"
-	}
-	parts := strings.SplitN(gcsBucketPrefix, "/", 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid gcs prefix for %s: %s", name, gcsBucketPrefix)
+// FindBuilds returns the builds of the job name that are stored under
+// location, ordered by their IDs. The location is parsed by ParseLocation. If
+// since is not empty, only builds whose IDs are not less than since are
+// returned.
+//
+// Builds are either directories under the location or, for presubmit jobs in
+// pr-logs/directory/<job>/, <build>.txt files that point to the directories.
+// The latter should be resolved by ResolveBuild.
+func (c *Client) FindBuilds(ctx context.Context, name, location, since string) ([]*Build, error) {
+	loc, err := ParseLocation(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location for %s: %w", name, err)
 	}
-	bucket, prefix := parts[0], parts[1]
 
-	klog.V(2).Infof("Searching for %s builds (gs://%s/%s)...", name, bucket, prefix)
+	klog.V(2).Infof("Searching for %s builds (%s)...", name, loc)
 
 	var builds []*Build
-	dirs, _, err := c.gcsListDir(ctx, bucket, prefix)
+	// Storages can skip objects only lexically, which would hide new builds
+	// once build IDs gain a digit, so builds are filtered numerically below.
+	dirs, files, err := c.listDir(ctx, loc.Scheme, loc.Bucket, loc.Prefix, "")
 	if err != nil {
 		return nil, err
 	}
+	for _, file := range files {
+		m := linkObject.FindStringSubmatch(file)
+		if m == nil {
+			continue
+		}
+		buildID := m[1]
+		if since != "" && CompareBuildIDs(buildID, since) < 0 {
+			continue
+		}
+		builds = append(builds, &Build{
+			Job:     name,
+			BuildID: buildID,
+			Scheme:  loc.Scheme,
+			Bucket:  loc.Bucket,
+			Link:    file,
+		})
+	}
 	for _, dir := range dirs {
-		if len(dir) <= len(prefix)+1 {
-			panic(fmt.Errorf("unexpected object from gcs: object is expected to have prefix %q, got %q", prefix, dir))
+		if len(dir) <= len(loc.Prefix)+1 {
+			panic(fmt.Errorf("unexpected object from %s: object is expected to have prefix %q, got %q", loc.Scheme, loc.Prefix, dir))
+		}
+		buildID := dir[len(loc.Prefix) : len(dir)-1]
+		if since != "" && CompareBuildIDs(buildID, since) < 0 {
+			continue
 		}
-		buildID := dir[len(prefix) : len(dir)-1]
 		build := &Build{
-			Job:       name,
-			BuildID:   buildID,
-			GCSBucket: bucket,
-			GCSPrefix: dir,
+			Job:     name,
+			BuildID: buildID,
+			Scheme:  loc.Scheme,
+			Bucket:  loc.Bucket,
+			Prefix:  dir,
 		}
 		builds = append(builds, build)
 	}
+	SortBuilds(builds)
 	return builds, nil
 }
 
 func (c *Client) GetBuildMeta(ctx context.Context, build *Build) (*BuildMeta, error) {
-	klog.V(4).Infof("Listing gs://%s/%s...", build.GCSBucket, build.GCSPrefix)
+	klog.V(4).Infof("Listing %s://%s/%s...", build.Scheme, build.Bucket, build.Prefix)
 
-	files, err := c.gcsListFiles(ctx, build.GCSBucket, build.GCSPrefix)
+	files, err := c.listFiles(ctx, build.Scheme, build.Bucket, build.Prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -241,11 +398,15 @@ func (c *Client) GetBuildMeta(ctx context.Context, build *Build) (*BuildMeta, er
 
 type StartedJson struct {
 	Timestamp int64
+
+	// Pull and Repos are set for presubmit builds.
+	Pull  string            `json:"pull"`
+	Repos map[string]string `json:"repos"`
 }
 
 func (c *Client) GetStartedJson(ctx context.Context, build *Build) (StartedJson, error) {
 	var j StartedJson
-	f, err := c.gcsOpen(ctx, build.GCSBucket, build.GCSPrefix+"started.json")
+	f, err := c.open(ctx, build.Scheme, build.Bucket, build.Prefix+"started.json")
 	if err != nil {
 		return j, err
 	}
@@ -261,7 +422,7 @@ type FinishedJson struct {
 
 func (c *Client) GetFinishedJson(ctx context.Context, build *Build) (FinishedJson, error) {
 	var j FinishedJson
-	f, err := c.gcsOpen(ctx, build.GCSBucket, build.GCSPrefix+"finished.json")
+	f, err := c.open(ctx, build.Scheme, build.Bucket, build.Prefix+"finished.json")
 	if err != nil {
 		return j, err
 	}
@@ -271,7 +432,7 @@ func (c *Client) GetFinishedJson(ctx context.Context, build *Build) (FinishedJso
 }
 
 func (c *Client) GetBuildStatus(ctx context.Context, buildMeta *BuildMeta) (*BuildStatus, error) {
-	if _, ok := buildMeta.Files[buildMeta.Build.GCSPrefix+"finished.json"]; !ok {
+	if _, ok := buildMeta.Files[buildMeta.Build.Prefix+"finished.json"]; !ok {
 		return nil, ErrNotFound
 	}
 
@@ -289,93 +450,43 @@ func (c *Client) GetBuildStatus(ctx context.Context, buildMeta *BuildMeta) (*Bui
 		StartedTimestamp:  started.Timestamp,
 		FinishedTimestamp: finished.Timestamp,
 		Result:            finished.Result,
+		Pull:              pullFromStarted(started),
 	}
-	return bs, nil
-}
-
-func analyzeSuite(suite junit.Suite) []*TestResult {
-	var results []*TestResult
-	for _, result := range suite.Results {
-		var output string
-		if result.Output != nil {
-			output = *result.Output
-			if !utf8.ValidString(output) {
-				output = fmt.Sprintf("invalid utf8: %s", strings.ToValidUTF8(output, "?"))
-			}
-		} else {
-			output = result.Message(1 << 20) // 1 MiB
+	if p := pullFromPrefix(buildMeta.Build.Prefix); p != nil {
+		if bs.Pull == nil {
+			bs.Pull = p
+		} else if bs.Pull.Repo == "" {
+			bs.Pull.Repo = p.Repo
 		}
-
-		var status TestStatus
-		if result.Failure != nil {
-			status = TestStatusFailure
-		} else if result.Error != nil {
-			status = TestStatusError
-		} else if result.Skipped != nil {
-			status = TestStatusSkipped
-		} else {
-			status = TestStatusSuccess
-		}
-
-		results = append(results, &TestResult{
-			Test:   result.Name,
-			Status: status,
-			Output: output,
-		})
-	}
-	return results
-}
-
-func analyzeSuites(suites []junit.Suite) []*TestResult {
-	var results []*TestResult
-	for _, suite := range suites {
-		results = append(results, analyzeSuite(suite)...)
 	}
-	return results
+	return bs, nil
 }
 
-func (c *Client) GetTestResults(ctx context.Context, buildMeta *BuildMeta) ([]*TestResult, error) {
-	var results []*TestResult
-	for objectName := range buildMeta.Files {
-		if junitObject.MatchString(objectName) {
-			f, err := c.gcsOpen(ctx, buildMeta.Build.GCSBucket, objectName)
-			if err != nil {
-				return results, err
-			}
-			suites, err := junit.ParseStream(f)
-			if err != nil {
-				return results, fmt.Errorf("unable to parse gs://%s/%s: %w", buildMeta.Build.GCSBucket, objectName, err)
-			}
-			testResults := analyzeSuites(suites.Suites)
-			f.Close()
-			results = append(results, testResults...)
-		}
+// validUTF8 replaces invalid UTF-8 sequences in s, so that it can be stored
+// in the database.
+func validUTF8(s string) string {
+	if !utf8.ValidString(s) {
+		return fmt.Sprintf("invalid utf8: %s", strings.ToValidUTF8(s, "?"))
 	}
-	return results, nil
+	return s
 }
 
+// GetBuildLogs returns the results for the build logs of the build. See
+// splitBuildLog for details.
 func (c *Client) GetBuildLogs(ctx context.Context, buildMeta *BuildMeta) ([]*TestResult, error) {
 	var results []*TestResult
-	for objectName := range buildMeta.Files {
-		if buildLogObject.MatchString(objectName) {
-			f, err := c.gcsOpen(ctx, buildMeta.Build.GCSBucket, objectName)
+	for _, objectName := range buildMeta.SortedFiles() {
+		if buildLogObject.MatchString(uncompressedName(objectName)) {
+			f, err := c.open(ctx, buildMeta.Build.Scheme, buildMeta.Build.Bucket, objectName)
 			if err != nil {
 				return results, err
 			}
-			content, err := ioutil.ReadAll(f)
-			if err != nil {
-				return results, fmt.Errorf("unable to read gs://%s/%s: %w", buildMeta.Build.GCSBucket, objectName, err)
-			}
+			logResults, err := splitBuildLog(uncompressedName(objectName[len(buildMeta.Build.Prefix):]), f, &c.logLimits)
 			f.Close()
-			if !utf8.Valid(content) {
-				content = bytes.ToValidUTF8(content, []byte("?"))
+			if err != nil {
+				return results, fmt.Errorf("unable to read %s://%s/%s: %w", buildMeta.Build.Scheme, buildMeta.Build.Bucket, objectName, err)
 			}
-			content = bytes.ReplaceAll(content, []byte("\x00"), []byte("?"))
-			results = append(results, &TestResult{
-				Test:   objectName[len(buildMeta.Build.GCSPrefix):],
-				Status: TestStatusInfo,
-				Output: string(content),
-			})
+			results = append(results, logResults...)
 		}
 	}
 	return results, nil
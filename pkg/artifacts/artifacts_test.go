@@ -0,0 +1,270 @@
+package artifacts
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompareBuildIDs(t *testing.T) {
+	testCases := []struct {
+		A, B string
+		Want int
+	}{
+		{A: "1", B: "2", Want: -1},
+		{A: "999", B: "1000", Want: -1},
+		{A: "1362009871432765440", B: "1362009871432765440", Want: 0},
+		{A: "1362009871432765441", B: "1362009871432765440", Want: 1},
+		{A: "abc", B: "abd", Want: -1},
+		{A: "10", B: "9a", Want: -1},
+	}
+	for _, tc := range testCases {
+		got := CompareBuildIDs(tc.A, tc.B)
+		if got != tc.Want {
+			t.Errorf("CompareBuildIDs(%q, %q): got %d, want %d", tc.A, tc.B, got, tc.Want)
+		}
+	}
+}
+
+func TestClientLocalStorage(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(1)
+	client.RegisterStorage("file", NewLocalStorage("/"), false)
+	if err := client.RegisterResultFormat("junit", `(^|/)junit.*\.xml$`); err != nil {
+		t.Fatal(err)
+	}
+
+	builds, err := client.FindBuilds(ctx, "test-job", "file://"+root+"/logs/test-job", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buildIDs []string
+	for _, b := range builds {
+		buildIDs = append(buildIDs, b.BuildID)
+	}
+	if !reflect.DeepEqual(buildIDs, []string{"99", "100"}) {
+		t.Fatalf("got builds %v, want [99 100]", buildIDs)
+	}
+
+	// Build 100 is lexically less than 99.
+	builds, err = client.FindBuilds(ctx, "test-job", "file://"+root+"/logs/test-job", "99")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 {
+		t.Fatalf("got %v, want builds 99 and 100", builds)
+	}
+
+	builds, err = client.FindBuilds(ctx, "test-job", "file://"+root+"/logs/test-job", "100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].BuildID != "100" {
+		t.Fatalf("got %v, want only build 100", builds)
+	}
+
+	buildMeta, err := client.GetBuildMeta(ctx, builds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetBuildStatus(ctx, buildMeta)
+	if err != ErrNotFound {
+		t.Errorf("unfinished build: got error %v, want %v", err, ErrNotFound)
+	}
+
+	buildMeta, err = client.GetBuildMeta(ctx, &Build{
+		Job:     "test-job",
+		BuildID: "99",
+		Scheme:  "file",
+		Prefix:  strings.TrimPrefix(root, "/") + "/logs/test-job/99/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := client.GetBuildStatus(ctx, buildMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.StartedTimestamp != 1613347200 || status.FinishedTimestamp != 1613350800 || status.Result != "FAILURE" {
+		t.Errorf("got status %+v", status)
+	}
+
+	// artifacts/metadata.json is not an object and is skipped.
+	metadata, err := client.GetBuildMetadata(ctx, buildMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, map[string]string{"owner": "team-a"}) {
+		t.Errorf("got metadata %v, want owner=team-a", metadata)
+	}
+
+	results, err := client.GetTestResults(ctx, buildMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]TestStatus{}
+	durations := map[string]time.Duration{}
+	hasDurations := map[string]bool{}
+	var failed, nested *TestResult
+	for _, r := range results {
+		name := r.Suite + ": " + r.Test
+		got[name] = r.Status
+		durations[name] = r.Duration
+		hasDurations[name] = r.HasDuration
+		if name == "e2e: fails" {
+			failed = r
+		}
+		if r.Suite == "operator/upgrade" {
+			nested = r
+		}
+	}
+	want := map[string]TestStatus{
+		"compressed: passes":       TestStatusSuccess,
+		"e2e: passes":              TestStatusSuccess,
+		"e2e: fails":               TestStatusFailure,
+		"e2e: skipped":             TestStatusSkipped,
+		"operator/upgrade: passes": TestStatusSuccess,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got test results %v, want %v", got, want)
+	}
+	if durations["e2e: passes"] != 1500*time.Millisecond || durations["e2e: fails"] != 2*time.Second {
+		t.Errorf("got test durations %v, want passes=1.5s, fails=2s", durations)
+	}
+	if !hasDurations["e2e: passes"] || hasDurations["e2e: skipped"] {
+		t.Errorf("got known durations %v, want passes known and skipped unknown", hasDurations)
+	}
+	if failed == nil || failed.Output != "error: something went wrong" || failed.SystemOut != "creating a pod" {
+		t.Errorf("got failed test result %+v, want the failure as the output and system-out", failed)
+	}
+	if nested == nil || !reflect.DeepEqual(nested.Properties, map[string]string{"owner": "team-a"}) || nested.Output != "" || nested.SystemOut != "stdout" || nested.SystemErr != "" {
+		t.Errorf("got nested test result %+v, want properties and system-out", nested)
+	}
+
+	logs, err := client.GetBuildLogs(ctx, buildMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotLogs []string
+	for _, r := range logs {
+		gotLogs = append(gotLogs, fmt.Sprintf("%s: %s %s %s %q", r.Suite, r.Test, r.Status, r.Duration, r.Output))
+	}
+	wantLogs := []string{
+		`: build-log.txt Info 0s "starting the job\nerror: the job failed"`,
+		`build-log.txt: e2e-install Success 40m0s "INFO[2021-02-15T00:00:00Z] Running step e2e-install.\nINFO[2021-02-15T00:40:00Z] Step e2e-install succeeded after 40m0s."`,
+		`build-log.txt: e2e-test Failure 10m0s "INFO[2021-02-15T00:40:01Z] Running step e2e-test.\nerror: the test failed\nINFO[2021-02-15T00:50:01Z] Step e2e-test failed after 10m0s."`,
+	}
+	if !reflect.DeepEqual(gotLogs, wantLogs) {
+		t.Errorf("got build logs %q, want %q", gotLogs, wantLogs)
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(1)
+	client.cacheDir = t.TempDir()
+	client.RegisterStorage("file", NewLocalStorage(root), true)
+
+	for _, object := range []string{
+		"logs/test-job/99/build-log.txt",
+		"logs/test-job/99/artifacts/junit_compressed.xml.gz",
+	} {
+		want, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(object)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(object, gzipSuffix) {
+			zr, err := gzip.NewReader(bytes.NewReader(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err = ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The first read downloads the object, the second one uses the cache.
+		for i := 0; i < 2; i++ {
+			f, err := client.open(ctx, "file", "", object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: read %d: got %q, want %q", object, i, got, want)
+			}
+		}
+
+		cached, err := ioutil.ReadFile(filepath.Join(client.cacheDir, "file", object))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isGzip(bufio.NewReader(bytes.NewReader(cached))) {
+			t.Errorf("%s: the cached file is not compressed", object)
+		}
+	}
+}
+
+func TestPullRefs(t *testing.T) {
+	started := StartedJson{
+		Pull: "25912",
+		Repos: map[string]string{
+			"openshift/origin": "master:0123abc,25912:4567def",
+		},
+	}
+	got := pullFromStarted(started)
+	want := &PullRef{Repo: "openshift/origin", Number: 25912, BaseSHA: "0123abc", HeadSHA: "4567def"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pullFromStarted: got %+v, want %+v", got, want)
+	}
+
+	testCases := []struct {
+		Prefix string
+		Want   *PullRef
+	}{
+		{
+			Prefix: "pr-logs/pull/openshift_cluster-image-registry-operator/123/pull-ci-e2e-aws/1362009871432765440/",
+			Want:   &PullRef{Repo: "openshift/cluster-image-registry-operator", Number: 123},
+		},
+		{
+			Prefix: "pr-logs/pull/25912/pull-ci-e2e-aws/1362009871432765440/",
+			Want:   &PullRef{Number: 25912},
+		},
+		{
+			Prefix: "logs/periodic-ci-e2e-aws/1362009871432765440/",
+			Want:   nil,
+		},
+	}
+	for _, tc := range testCases {
+		got := pullFromPrefix(tc.Prefix)
+		if !reflect.DeepEqual(got, tc.Want) {
+			t.Errorf("pullFromPrefix(%q): got %+v, want %+v", tc.Prefix, got, tc.Want)
+		}
+	}
+}
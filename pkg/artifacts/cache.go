@@ -0,0 +1,105 @@
+package artifacts
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultCacheDir is the directory where downloaded artifacts are stored.
+const DefaultCacheDir = "./cache"
+
+// PruneStats describes what was deleted from the cache.
+type PruneStats struct {
+	Files int
+	Bytes int64
+
+	// RemainingFiles and RemainingBytes describe what is left in the cache.
+	RemainingFiles int
+	RemainingBytes int64
+}
+
+type cacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// PruneCache deletes files from the cache directory dir that were not used
+// for longer than maxAge, and then the least recently used files until the
+// cache is not bigger than maxSize. Zero values disable the corresponding
+// limits.
+func PruneCache(dir string, maxAge time.Duration, maxSize int64) (PruneStats, error) {
+	var stats PruneStats
+	var files []cacheFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Files that are being downloaded are not part of the cache yet.
+		if info.IsDir() || strings.HasSuffix(path, ".part") {
+			return nil
+		}
+		files = append(files, cacheFile{
+			path:    path,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	var totalSize int64
+	for _, f := range files {
+		totalSize += f.size
+	}
+
+	now := time.Now()
+	for _, f := range files {
+		expired := maxAge != 0 && now.Sub(f.modTime) > maxAge
+		tooBig := maxSize != 0 && totalSize > maxSize
+		if !expired && !tooBig {
+			stats.RemainingFiles++
+			stats.RemainingBytes += f.size
+			continue
+		}
+		err := os.Remove(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return stats, err
+		}
+		stats.Files++
+		stats.Bytes += f.size
+		totalSize -= f.size
+	}
+
+	removeEmptyDirs(dir)
+
+	return stats, nil
+}
+
+// removeEmptyDirs removes empty subdirectories of dir. Errors are ignored as
+// directories may be populated concurrently by the indexer.
+func removeEmptyDirs(dir string) {
+	var dirs []string
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != dir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	// Children go after their parents, so remove them in reverse order.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+}
@@ -0,0 +1,77 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// GCSStorage provides access to Google Cloud Storage.
+type GCSStorage struct {
+	client *storage.Client
+}
+
+var _ Storage = &GCSStorage{}
+
+func NewGCSStorage(client *storage.Client) *GCSStorage {
+	return &GCSStorage{
+		client: client,
+	}
+}
+
+func (s *GCSStorage) ListDir(ctx context.Context, bucket, prefix, startOffset string) (dirs []string, files []string, err error) {
+	bkt := s.client.Bucket(bucket)
+	it := bkt.Objects(ctx, &storage.Query{
+		Delimiter:   "/",
+		Prefix:      prefix,
+		StartOffset: startOffset,
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if attrs.Prefix == "" {
+			files = append(files, attrs.Name)
+		} else {
+			dirs = append(dirs, attrs.Prefix)
+		}
+	}
+	return dirs, files, nil
+}
+
+func (s *GCSStorage) ListFiles(ctx context.Context, bucket, prefix string) (files []string, err error) {
+	bkt := s.client.Bucket(bucket)
+	it := bkt.Objects(ctx, &storage.Query{
+		Prefix: prefix,
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, attrs.Name)
+	}
+	return files, nil
+}
+
+func (s *GCSStorage) Open(ctx context.Context, bucket, object string) (io.ReadCloser, error) {
+	// Objects with Content-Encoding: gzip are downloaded without
+	// decompression, so that they are stored compressed in the cache.
+	r, err := s.client.Bucket(bucket).Object(object).ReadCompressed(true).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, fmt.Errorf("unable to open gs://%s/%s: %w", bucket, object, ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open gs://%s/%s: %w", bucket, object, err)
+	}
+	return r, nil
+}
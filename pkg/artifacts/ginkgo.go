@@ -0,0 +1,277 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GinkgoReport is the subset of a Ginkgo v2 JSON report (ginkgo
+// --json-report) that is used to build test results.
+type GinkgoReport struct {
+	SuiteDescription string
+	SuitePath        string
+	SpecReports      []GinkgoSpecReport
+}
+
+type GinkgoCodeLocation struct {
+	FileName       string
+	LineNumber     int
+	FullStackTrace string
+}
+
+func (l GinkgoCodeLocation) String() string {
+	if l.FileName == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", l.FileName, l.LineNumber)
+}
+
+type GinkgoTimelineLocation struct {
+	Order int
+}
+
+type GinkgoSpecReport struct {
+	ContainerHierarchyTexts  []string
+	ContainerHierarchyLabels [][]string
+	LeafNodeType             string
+	LeafNodeText             string
+	LeafNodeLabels           []string
+	State                    string
+	RunTime                  time.Duration
+	Failure                  struct {
+		Message         string
+		Location        GinkgoCodeLocation
+		ForwardedPanic  string
+		FailureNodeType string
+	}
+	CapturedGinkgoWriterOutput string
+	CapturedStdOutErr          string
+	ReportEntries              []struct {
+		Name             string
+		TimelineLocation GinkgoTimelineLocation
+		Value            struct {
+			Representation string
+		}
+	}
+	SpecEvents []struct {
+		SpecEventType    string
+		Message          string
+		TimelineLocation GinkgoTimelineLocation
+	}
+}
+
+// Name returns the full text of the spec. Specs that are not It nodes, like
+// BeforeSuite, are named after their node type.
+func (s *GinkgoSpecReport) Name() string {
+	if s.LeafNodeType != "" && s.LeafNodeType != "It" && s.LeafNodeText == "" && len(s.ContainerHierarchyTexts) == 0 {
+		return "[" + s.LeafNodeType + "]"
+	}
+	texts := append(append([]string(nil), s.ContainerHierarchyTexts...), s.LeafNodeText)
+	return strings.TrimSpace(strings.Join(texts, " "))
+}
+
+// Labels returns the labels of the spec and its containers.
+func (s *GinkgoSpecReport) Labels() []string {
+	seen := map[string]bool{}
+	var labels []string
+	for _, l := range append(s.ContainerHierarchyLabels, s.LeafNodeLabels) {
+		for _, label := range l {
+			if !seen[label] {
+				seen[label] = true
+				labels = append(labels, label)
+			}
+		}
+	}
+	return labels
+}
+
+// timeline returns the steps and report entries of the spec in the order in
+// which they happened.
+func (s *GinkgoSpecReport) timeline() []string {
+	type event struct {
+		order int
+		text  string
+	}
+	var events []event
+	for _, e := range s.SpecEvents {
+		if e.SpecEventType == "By" {
+			events = append(events, event{e.TimelineLocation.Order, "STEP: " + e.Message})
+		}
+	}
+	for _, e := range s.ReportEntries {
+		events = append(events, event{e.TimelineLocation.Order, e.Name + ": " + e.Value.Representation})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].order < events[j].order
+	})
+	var lines []string
+	for _, e := range events {
+		lines = append(lines, e.text)
+	}
+	return lines
+}
+
+func (s *GinkgoSpecReport) status() TestStatus {
+	switch s.State {
+	case "passed":
+		return TestStatusSuccess
+	case "skipped", "pending":
+		return TestStatusSkipped
+	case "failed", "timedout":
+		return TestStatusFailure
+	default:
+		// aborted, panicked, interrupted
+		return TestStatusError
+	}
+}
+
+func (s *GinkgoSpecReport) output() string {
+	var buf strings.Builder
+	if s.Failure.Message != "" {
+		fmt.Fprintf(&buf, "[%s] %s\n", strings.ToUpper(s.State), s.Failure.Message)
+		if loc := s.Failure.Location.String(); loc != "" {
+			fmt.Fprintf(&buf, "In [%s] at: %s\n", s.Failure.FailureNodeType, loc)
+		}
+		if s.Failure.ForwardedPanic != "" {
+			fmt.Fprintf(&buf, "%s\n", s.Failure.ForwardedPanic)
+		}
+		if s.Failure.Location.FullStackTrace != "" {
+			fmt.Fprintf(&buf, "%s\n", s.Failure.Location.FullStackTrace)
+		}
+	}
+	if timeline := s.timeline(); len(timeline) != 0 {
+		fmt.Fprintf(&buf, "Timeline:\n%s\n", strings.Join(timeline, "\n"))
+	}
+	if s.CapturedGinkgoWriterOutput != "" {
+		fmt.Fprintf(&buf, "%s\n", s.CapturedGinkgoWriterOutput)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// ParseGinkgoReport extracts test results from a Ginkgo v2 JSON report. Spec
+// labels and the failure location are stored as the properties labels and
+// failure_location. The report is read one spec at a time, so it doesn't have
+// to fit in memory.
+func ParseGinkgoReport(name string, r io.Reader, limits *LogLimits) ([]*TestResult, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '['); err != nil {
+		return nil, err
+	}
+	var results []*TestResult
+	for dec.More() {
+		reportResults, err := parseGinkgoSuiteReport(dec)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, reportResults...)
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// parseGinkgoSuiteReport reads a GinkgoReport from dec and returns the
+// results of its specs.
+func parseGinkgoSuiteReport(dec *json.Decoder) ([]*TestResult, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	var suite string
+	var results []*TestResult
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		switch key {
+		case "SuiteDescription":
+			err = dec.Decode(&suite)
+		case "SpecReports":
+			err = decodeArray(dec, func() error {
+				var spec GinkgoSpecReport
+				if err := dec.Decode(&spec); err != nil {
+					return err
+				}
+				results = append(results, spec.result())
+				return nil
+			})
+		default:
+			var skipped json.RawMessage
+			err = dec.Decode(&skipped)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	// SuiteDescription may follow SpecReports.
+	for _, r := range results {
+		r.Suite = suite
+	}
+	return results, nil
+}
+
+// result returns the TestResult for the spec.
+func (s *GinkgoSpecReport) result() *TestResult {
+	properties := map[string]string{}
+	if labels := s.Labels(); len(labels) != 0 {
+		properties["labels"] = strings.Join(labels, ",")
+	}
+	if loc := s.Failure.Location.String(); loc != "" {
+		properties["failure_location"] = loc
+	}
+	if len(properties) == 0 {
+		properties = nil
+	}
+	return &TestResult{
+		Test:        s.Name(),
+		Status:      s.status(),
+		Output:      validUTF8(s.output()),
+		Properties:  properties,
+		SystemOut:   validUTF8(s.CapturedStdOutErr),
+		Duration:    s.RunTime,
+		HasDuration: true,
+	}
+}
+
+// decodeArray calls decodeElem for each element of the JSON array that is
+// the next value in dec. A null value is treated as an empty array.
+func decodeArray(dec *json.Decoder, decodeElem func() error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected [, got %v", tok)
+	}
+	for dec.More() {
+		if err := decodeElem(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// expectDelim reads the next token from dec and returns an error if it's not
+// the delimiter want.
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("expected %v, got %v", want, tok)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package artifacts
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	goTestRunRe     = regexp.MustCompile(`^=== (?:RUN|CONT|PAUSE|NAME)\s+(\S+)`)
+	goTestStatusRe  = regexp.MustCompile(`^\s*--- (PASS|FAIL|SKIP): (\S+) \(([0-9.]+)(?:s| seconds)\)`)
+	goTestPackageRe = regexp.MustCompile(`^(ok|FAIL)\s+(\S+)\s+(?:([0-9.]+)s|\(cached\)|(\[[\w ]+ failed\]))`)
+	goTestPanicRe   = regexp.MustCompile(`^panic: `)
+	goTestSummaryRe = regexp.MustCompile(`^(PASS|FAIL)$`)
+)
+
+// goTestEvent is an event that is printed by go test -json.
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+type goTest struct {
+	result *TestResult
+	output *logWindow
+	done   bool
+
+	// partial is the last line of the output from go test -json if it
+	// doesn't end with a newline yet.
+	partial string
+}
+
+// write adds the output s from go test -json to the test. Lines may be split
+// across events.
+func (t *goTest) write(s string, maxLineBytes int) {
+	lines := strings.Split(t.partial+s, "\n")
+	t.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		t.output.add(line)
+	}
+	if maxLineBytes != 0 && len(t.partial) > maxLineBytes {
+		t.output.add(strings.ToValidUTF8(t.partial[:maxLineBytes], "") + " [line truncated]")
+		t.partial = ""
+	}
+}
+
+// goTestParser collects test results from the output of go test -v and go
+// test -json. Both formats may be mixed in one file.
+type goTestParser struct {
+	limits *LogLimits
+	tests  []*goTest
+
+	// running holds the tests that don't have a package yet, by name. The
+	// output of go test -v names the package only after all its tests.
+	running map[string]*goTest
+
+	// current is the test that gets lines that are not recognized.
+	current *goTest
+
+	// jsonTests holds the tests from go test -json by package and name.
+	jsonTests map[string]*goTest
+}
+
+func newGoTestParser(limits *LogLimits) *goTestParser {
+	return &goTestParser{
+		limits:    limits,
+		running:   map[string]*goTest{},
+		jsonTests: map[string]*goTest{},
+	}
+}
+
+func (p *goTestParser) newTest(suite, name string) *goTest {
+	t := &goTest{
+		result: &TestResult{
+			Suite:  suite,
+			Test:   name,
+			Status: TestStatusInfo,
+		},
+		output: newLogWindow(p.limits),
+	}
+	p.tests = append(p.tests, t)
+	return t
+}
+
+func parseGoTestStatus(s string) TestStatus {
+	switch s {
+	case "PASS", "pass":
+		return TestStatusSuccess
+	case "FAIL", "fail":
+		return TestStatusFailure
+	default:
+		return TestStatusSkipped
+	}
+}
+
+func parseSeconds(s string) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// finishPackage assigns the tests that are still pending to the package pkg.
+// Tests that didn't report their results failed if the package failed, e.g.
+// because of a panic or a timeout.
+func (p *goTestParser) finishPackage(pkg string, failed bool) {
+	for name, t := range p.running {
+		t.result.Suite = pkg
+		if !t.done && failed {
+			t.result.Status = TestStatusFailure
+		}
+		delete(p.running, name)
+	}
+	p.current = nil
+}
+
+func (p *goTestParser) processEvent(e *goTestEvent) {
+	if e.Test == "" {
+		if e.Action == "fail" {
+			for _, t := range p.jsonTests {
+				if t.result.Suite == e.Package && !t.done {
+					t.result.Status = TestStatusFailure
+					t.done = true
+				}
+			}
+		}
+		return
+	}
+
+	key := e.Package + "\x00" + e.Test
+	t, ok := p.jsonTests[key]
+	if !ok {
+		t = p.newTest(e.Package, e.Test)
+		p.jsonTests[key] = t
+	}
+	switch e.Action {
+	case "output":
+		t.write(e.Output, p.limits.MaxLineBytes)
+	case "pass", "fail", "skip":
+		t.result.Status = parseGoTestStatus(e.Action)
+		t.result.Duration = time.Duration(e.Elapsed * float64(time.Second))
+		t.result.HasDuration = true
+		t.done = true
+	}
+}
+
+func (p *goTestParser) processLine(line string) {
+	if strings.HasPrefix(line, "{") {
+		var e goTestEvent
+		if err := json.Unmarshal([]byte(line), &e); err == nil && e.Action != "" {
+			p.processEvent(&e)
+			return
+		}
+	}
+
+	if m := goTestRunRe.FindStringSubmatch(line); m != nil {
+		t, ok := p.running[m[1]]
+		if !ok {
+			t = p.newTest("", m[1])
+			p.running[m[1]] = t
+		}
+		p.current = t
+	} else if m := goTestStatusRe.FindStringSubmatch(line); m != nil {
+		t, ok := p.running[m[2]]
+		if !ok {
+			t = p.newTest("", m[2])
+			p.running[m[2]] = t
+		}
+		t.result.Status = parseGoTestStatus(m[1])
+		t.result.Duration, t.result.HasDuration = parseSeconds(m[3])
+		t.done = true
+		// The output of subtests and older versions of go test follow the
+		// status line.
+		p.current = t
+	} else if m := goTestPackageRe.FindStringSubmatch(line); m != nil {
+		failed := m[1] == "FAIL"
+		if m[4] != "" {
+			t := p.newTest(m[2], m[4])
+			t.result.Status = TestStatusFailure
+			t.output.add(line)
+		}
+		p.finishPackage(m[2], failed)
+		return
+	} else if goTestSummaryRe.MatchString(line) {
+		p.current = nil
+		return
+	} else if goTestPanicRe.MatchString(line) && p.current != nil && p.current.done {
+		// A panic may happen in a test that is still running after the
+		// current one has finished. Blame the latest one.
+		for i := len(p.tests) - 1; i >= 0; i-- {
+			t := p.tests[i]
+			if p.running[t.result.Test] == t && !t.done {
+				p.current = t
+				break
+			}
+		}
+	}
+
+	if p.current != nil {
+		p.current.output.add(line)
+	}
+}
+
+// results returns the collected results. Tests that were running when the
+// output ended are considered failed.
+func (p *goTestParser) results() []*TestResult {
+	p.finishPackage("", true)
+
+	var results []*TestResult
+	for _, t := range p.tests {
+		if !t.done && t.result.Status == TestStatusInfo {
+			t.result.Status = TestStatusFailure
+		}
+		if t.partial != "" {
+			t.output.add(t.partial)
+		}
+		t.result.Output = validUTF8(t.output.String())
+		results = append(results, t.result)
+	}
+	return results
+}
+
+// ParseGoTestOutput extracts test results from the output of go test -v or
+// go test -json. The package of a test is stored as its suite. The outputs
+// of tests are bounded by limits.
+func ParseGoTestOutput(r io.Reader, limits *LogLimits) ([]*TestResult, error) {
+	p := newGoTestParser(limits)
+	err := scanLines(r, limits.MaxLineBytes, p.processLine)
+	if err != nil {
+		return nil, err
+	}
+	return p.results(), nil
+}
+
+// GetGoTestResults extracts test results from the build's files whose names
+// (relative to the build) are accepted by match.
+func (c *Client) GetGoTestResults(ctx context.Context, buildMeta *BuildMeta, match func(name string) bool) ([]*TestResult, error) {
+	var results []*TestResult
+	for _, objectName := range buildMeta.SortedFiles() {
+		if !match(uncompressedName(objectName[len(buildMeta.Build.Prefix):])) {
+			continue
+		}
+		testResults, err := c.parseFile(ctx, buildMeta, objectName, ResultParsers["gotest"])
+		if err != nil {
+			return results, err
+		}
+		results = append(results, testResults...)
+	}
+	return results, nil
+}
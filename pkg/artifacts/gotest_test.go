@@ -0,0 +1,105 @@
+package artifacts
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGoTestOutput(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Input  string
+		Output []string
+	}{
+		{
+			Name: "verbose",
+			Input: `=== RUN   TestA
+--- PASS: TestA (0.50s)
+=== RUN   TestB
+=== RUN   TestB/sub
+    b_test.go:10: boom
+--- FAIL: TestB (1.00s)
+    --- FAIL: TestB/sub (1.00s)
+=== RUN   TestC
+--- SKIP: TestC (0.00s)
+FAIL
+FAIL	example.com/pkg/b	1.234s
+`,
+			Output: []string{
+				`example.com/pkg/b: TestA Success 500ms "=== RUN   TestA\n--- PASS: TestA (0.50s)"`,
+				`example.com/pkg/b: TestB Failure 1s "=== RUN   TestB\n--- FAIL: TestB (1.00s)"`,
+				`example.com/pkg/b: TestB/sub Failure 1s "=== RUN   TestB/sub\n    b_test.go:10: boom\n    --- FAIL: TestB/sub (1.00s)"`,
+				`example.com/pkg/b: TestC Skipped 0s "=== RUN   TestC\n--- SKIP: TestC (0.00s)"`,
+			},
+		},
+		{
+			Name: "panic",
+			Input: `=== RUN   TestA
+--- PASS: TestA (0.01s)
+=== RUN   TestPanic
+panic: runtime error: invalid memory address or nil pointer dereference [recovered]
+goroutine 7 [running]:
+FAIL	example.com/pkg/c	0.020s
+ok  	example.com/pkg/d	0.100s
+`,
+			Output: []string{
+				`example.com/pkg/c: TestA Success 10ms "=== RUN   TestA\n--- PASS: TestA (0.01s)"`,
+				`example.com/pkg/c: TestPanic Failure 0s "=== RUN   TestPanic\npanic: runtime error: invalid memory address or nil pointer dereference [recovered]\ngoroutine 7 [running]:"`,
+			},
+		},
+		{
+			Name: "build failure",
+			Input: `# example.com/pkg/e
+./e.go:3:1: syntax error
+FAIL	example.com/pkg/e [build failed]
+`,
+			Output: []string{
+				`example.com/pkg/e: [build failed] Failure 0s "FAIL\texample.com/pkg/e [build failed]"`,
+			},
+		},
+		{
+			Name: "json",
+			Input: `{"Action":"run","Package":"example.com/pkg/f","Test":"TestA"}
+{"Action":"output","Package":"example.com/pkg/f","Test":"TestA","Output":"=== RUN   TestA\n"}
+{"Action":"output","Package":"example.com/pkg/f","Test":"TestA","Output":"--- FAIL: TestA (0.20s)\n"}
+{"Action":"fail","Package":"example.com/pkg/f","Test":"TestA","Elapsed":0.2}
+{"Action":"run","Package":"example.com/pkg/f","Test":"TestTimeout"}
+{"Action":"output","Package":"example.com/pkg/f","Test":"TestTimeout","Output":"panic: test timed out after 10m0s\n"}
+{"Action":"fail","Package":"example.com/pkg/f","Elapsed":600}
+`,
+			Output: []string{
+				`example.com/pkg/f: TestA Failure 200ms "=== RUN   TestA\n--- FAIL: TestA (0.20s)"`,
+				`example.com/pkg/f: TestTimeout Failure 0s "panic: test timed out after 10m0s"`,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		results, err := ParseGoTestOutput(strings.NewReader(tc.Input), &LogLimits{})
+		if err != nil {
+			t.Errorf("%s: %s", tc.Name, err)
+			continue
+		}
+		var output []string
+		for _, r := range results {
+			output = append(output, fmt.Sprintf("%s: %s %s %s %q", r.Suite, r.Test, r.Status, r.Duration, r.Output))
+		}
+		if !reflect.DeepEqual(output, tc.Output) {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.Name, strings.Join(output, "\n"), strings.Join(tc.Output, "\n"))
+		}
+	}
+}
+
+func TestParseGoTestOutputLimits(t *testing.T) {
+	limits := &LogLimits{MaxLineBytes: 30}
+	input := "=== RUN   TestA\n" + strings.Repeat("x", 1<<20) + "\n--- FAIL: TestA (0.20s)\n"
+	results, err := ParseGoTestOutput(strings.NewReader(input), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "=== RUN   TestA\n" + strings.Repeat("x", 30) + " [line truncated]\n--- FAIL: TestA (0.20s)"
+	if len(results) != 1 || results[0].Output != want {
+		t.Errorf("got %d results, want one result with output %q", len(results), want)
+	}
+}
@@ -0,0 +1,73 @@
+package artifacts
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// gzipSuffix is the suffix of compressed artifacts. It's ignored when
+// artifacts are matched against patterns and used as test names.
+const gzipSuffix = ".gz"
+
+// uncompressedName returns the name of the artifact name without the gzip
+// suffix, e.g. build-log.txt for build-log.txt.gz.
+func uncompressedName(name string) string {
+	return strings.TrimSuffix(name, gzipSuffix)
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// isGzip reports whether the content of br starts with the gzip magic bytes.
+func isGzip(br *bufio.Reader) bool {
+	magic, err := br.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// compress copies r to w. The content is compressed with gzip unless it's
+// already compressed.
+func compress(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if isGzip(br) {
+		_, err := io.Copy(w, br)
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := io.Copy(zw, br); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// decompress returns a reader that decompresses rc if its content starts
+// with the gzip magic bytes. Objects that are stored with Content-Encoding:
+// gzip are downloaded as is, so they are detected in the same way as files
+// with the .gz suffix.
+func decompress(rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	if !isGzip(br) {
+		return &readCloser{Reader: br, closers: []io.Closer{rc}}, nil
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: zr, closers: []io.Closer{zr, rc}}, nil
+}
@@ -0,0 +1,197 @@
+package artifacts
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/GoogleCloudPlatform/testgrid/metadata/junit"
+)
+
+// junitCharsetReader accepts the charsets that the junit package accepts.
+func junitCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch charset {
+	case "UTF-8", "utf8", "":
+		// utf8 is not a valid name, but some tools write it.
+		return input, nil
+	default:
+		return nil, fmt.Errorf("unknown charset: %s", charset)
+	}
+}
+
+// junitSuite is an open <testsuite> element.
+type junitSuite struct {
+	path       string
+	properties map[string]string
+
+	// first is the index of the first result of the suite and its nested
+	// suites.
+	first int
+}
+
+// ParseJUnit extracts test results from a JUnit XML file. The file is read
+// one <testcase> at a time, so it doesn't have to fit in memory. The root
+// element may be either <testsuites> or <testsuite>. The properties of
+// suites are inherited by their test cases unless the test cases set them.
+func ParseJUnit(name string, r io.Reader, limits *LogLimits) ([]*TestResult, error) {
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = junitCharsetReader
+
+	var results []*TestResult
+	var suites []*junitSuite
+	root := true
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root {
+				if t.Name.Local != "testsuites" && t.Name.Local != "testsuite" {
+					return nil, fmt.Errorf("bad element name: %q", t.Name.Local)
+				}
+				root = false
+			}
+			var parent *junitSuite
+			if len(suites) != 0 {
+				parent = suites[len(suites)-1]
+			}
+			switch {
+			case t.Name.Local == "testsuite":
+				path := xmlAttr(t, "name")
+				if parent != nil {
+					path = parent.path + SuitePathSeparator + path
+				}
+				suites = append(suites, &junitSuite{path: path, first: len(results)})
+			case t.Name.Local == "testcase":
+				var tc junitTestCase
+				if err := dec.DecodeElement(&tc, &t); err != nil {
+					return nil, err
+				}
+				var path string
+				if parent != nil {
+					path = parent.path
+				}
+				results = append(results, junitResult(path, &tc))
+			case parent == nil:
+				// Children of <testsuites> are not used.
+			case t.Name.Local == "properties":
+				var properties junit.Properties
+				if err := dec.DecodeElement(&properties, &t); err != nil {
+					return nil, err
+				}
+				for _, p := range properties.PropertyList {
+					if parent.properties == nil {
+						parent.properties = map[string]string{}
+					}
+					parent.properties[p.Name] = validUTF8(p.Value)
+				}
+			default:
+				// Other suite-level elements like <system-out> are not
+				// used.
+				if err := dec.Skip(); err != nil {
+					return nil, err
+				}
+			}
+		case xml.EndElement:
+			if t.Name.Local == "testsuite" && len(suites) != 0 {
+				// <properties> may follow the test cases, so they are
+				// applied once the suite is closed. The properties of
+				// nested suites are already applied at this point and
+				// take precedence.
+				suite := suites[len(suites)-1]
+				suites = suites[:len(suites)-1]
+				for _, r := range results[suite.first:] {
+					inheritProperties(r, suite.properties)
+				}
+			}
+		}
+	}
+	return results, nil
+}
+
+// inheritProperties adds the properties to r unless r already has them.
+func inheritProperties(r *TestResult, properties map[string]string) {
+	for k, v := range properties {
+		if _, ok := r.Properties[k]; ok {
+			continue
+		}
+		if r.Properties == nil {
+			r.Properties = map[string]string{}
+		}
+		r.Properties[k] = v
+	}
+}
+
+// xmlAttr returns the value of the attribute name of the element, or an
+// empty string if the element doesn't have it.
+func xmlAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// junitTestCase is a <testcase> element. junit.Result stores <system-out> as
+// Output and <system-err> as Error, and it doesn't have the <error> element.
+type junitTestCase struct {
+	junit.Result
+	ErrorMessage *string `xml:"error,omitempty"`
+}
+
+// junitResult converts the test case of the suite path into a TestResult.
+// The output of the result is the text of the <failure>, <error> or
+// <skipped> element.
+func junitResult(path string, tc *junitTestCase) *TestResult {
+	var output string
+	var status TestStatus
+	if tc.Failure != nil {
+		status = TestStatusFailure
+		output = *tc.Failure
+	} else if tc.ErrorMessage != nil {
+		status = TestStatusError
+		output = *tc.ErrorMessage
+	} else if tc.Skipped != nil {
+		status = TestStatusSkipped
+		output = *tc.Skipped
+	} else {
+		status = TestStatusSuccess
+	}
+
+	var properties map[string]string
+	if tc.Properties != nil && len(tc.Properties.PropertyList) != 0 {
+		properties = map[string]string{}
+		for _, p := range tc.Properties.PropertyList {
+			properties[p.Name] = validUTF8(p.Value)
+		}
+	}
+
+	var systemOut, systemErr string
+	if tc.Output != nil {
+		systemOut = validUTF8(*tc.Output)
+	}
+	if tc.Error != nil {
+		systemErr = validUTF8(*tc.Error)
+	}
+
+	return &TestResult{
+		Suite:      path,
+		Test:       tc.Name,
+		Status:     status,
+		Output:     validUTF8(output),
+		Properties: properties,
+		SystemOut:  systemOut,
+		SystemErr:  systemErr,
+		Duration:   time.Duration(tc.Time * float64(time.Second)),
+		// The junit package doesn't distinguish a missing time attribute
+		// from zero.
+		HasDuration: tc.Time > 0,
+	}
+}
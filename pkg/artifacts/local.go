@@ -0,0 +1,99 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStorage provides access to a directory on the local filesystem. The
+// bucket is a subdirectory of the root directory.
+type LocalStorage struct {
+	root string
+}
+
+var _ Storage = &LocalStorage{}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{
+		root: root,
+	}
+}
+
+func (s *LocalStorage) path(bucket, object string) string {
+	return filepath.Join(s.root, bucket, filepath.FromSlash(object))
+}
+
+func (s *LocalStorage) ListDir(ctx context.Context, bucket, prefix, startOffset string) (dirs []string, files []string, err error) {
+	// The prefix may end in the middle of a name.
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	namePrefix := prefix[len(dir):]
+
+	entries, err := ioutil.ReadDir(s.path(bucket, dir))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		name := dir + entry.Name()
+		if !strings.HasPrefix(entry.Name(), namePrefix) || name < startOffset {
+			continue
+		}
+		if entry.IsDir() {
+			dirs = append(dirs, name+"/")
+		} else {
+			files = append(files, name)
+		}
+	}
+	return dirs, files, nil
+}
+
+func (s *LocalStorage) ListFiles(ctx context.Context, bucket, prefix string) ([]string, error) {
+	base := s.path(bucket, "")
+	var files []string
+	err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// Skip directories that can't contain objects with the prefix.
+			rel, err := filepath.Rel(base, path)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel) + "/"
+			if rel != "." && !strings.HasPrefix(name, prefix) && !strings.HasPrefix(prefix, name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			files = append(files, name)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	sort.Strings(files)
+	return files, err
+}
+
+func (s *LocalStorage) Open(ctx context.Context, bucket, object string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(bucket, object))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to open %s: %w", s.path(bucket, object), ErrNotFound)
+	}
+	return f, err
+}
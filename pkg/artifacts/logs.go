@@ -0,0 +1,264 @@
+package artifacts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// LogLimits bounds the memory that is used to process build logs and the
+// size of their stored output. Zero values mean no limit.
+type LogLimits struct {
+	// MaxBytes is the maximum size of the output of a log segment. Segments
+	// that are bigger are reduced to their beginning and excerpts around
+	// error lines.
+	MaxBytes int
+
+	// HeadBytes is the size of the beginning of a segment that is kept when
+	// the segment is bigger than MaxBytes.
+	HeadBytes int
+
+	// ContextLines is the number of lines before and after error lines that
+	// are kept in excerpts.
+	ContextLines int
+
+	// MaxLineBytes is the maximum length of a line. Longer lines are cut.
+	MaxLineBytes int
+
+	// IsErrorLine reports whether a line should be kept in excerpts.
+	IsErrorLine func(line string) bool
+}
+
+// SetLogLimits sets the limits that are used by GetBuildLogs.
+func (c *Client) SetLogLimits(limits LogLimits) {
+	c.logLimits = limits
+}
+
+// logEntry is a line of a tail excerpt.
+type logEntry struct {
+	// gap is the number of lines that are omitted before line.
+	gap  int
+	line string
+}
+
+func gapMarker(omittedLines int) string {
+	if omittedLines == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[... %d lines omitted ...]\n", omittedLines)
+}
+
+func (e logEntry) size() int {
+	return len(gapMarker(e.gap)) + len(e.line) + 1
+}
+
+// logWindow accumulates the output of a log segment within limits. Until the
+// output exceeds MaxBytes, all lines are kept. After that, only the head of
+// the segment and error lines with their context are kept, and the number of
+// omitted lines is recorded in the output.
+//
+// The budget for excerpts is split in two halves. The first half keeps the
+// first excerpts. The second half keeps the last excerpts and drops older
+// ones as new ones come, so that the final errors of the segment, which
+// usually explain the failure, are not lost.
+type logWindow struct {
+	limits *LogLimits
+
+	// lines holds all lines until the window switches to excerpts.
+	lines     []string
+	linesSize int
+	excerpts  bool
+
+	out strings.Builder
+
+	// before holds the lines that may become the context of the next error
+	// line, after is the number of lines to keep after the last error line.
+	before []string
+	after  int
+
+	// firstBytes is the size of the output up to which the first excerpts
+	// are kept. Later excerpts go to tail, whose size is bounded by
+	// tailBytes.
+	firstBytes int
+	tailBytes  int
+	inTail     bool
+	tail       []logEntry
+	tailSize   int
+
+	omittedLines int
+	omittedBytes int
+	totalBytes   int
+}
+
+func newLogWindow(limits *LogLimits) *logWindow {
+	return &logWindow{
+		limits: limits,
+	}
+}
+
+func (w *logWindow) add(line string) {
+	w.totalBytes += len(line) + 1
+	if w.excerpts {
+		w.addExcerpt(line)
+		return
+	}
+
+	if w.limits.MaxBytes == 0 || w.linesSize+len(line)+1 <= w.limits.MaxBytes {
+		w.lines = append(w.lines, line)
+		w.linesSize += len(line) + 1
+		return
+	}
+
+	// The segment is too big, keep its head and reprocess the rest of the
+	// lines as excerpts.
+	w.excerpts = true
+	lines := w.lines
+	w.lines = nil
+	i := 0
+	for ; i < len(lines) && w.out.Len()+len(lines[i])+1 <= w.limits.HeadBytes; i++ {
+		w.out.WriteString(lines[i])
+		w.out.WriteString("\n")
+	}
+	w.tailBytes = (w.limits.MaxBytes - w.out.Len()) / 2
+	w.firstBytes = w.limits.MaxBytes - w.tailBytes
+	for ; i < len(lines); i++ {
+		w.addExcerpt(lines[i])
+	}
+	w.addExcerpt(line)
+}
+
+func (w *logWindow) omit(line string) {
+	w.omittedLines++
+	w.omittedBytes += len(line) + 1
+}
+
+func (w *logWindow) writeGap() {
+	w.out.WriteString(gapMarker(w.omittedLines))
+	w.omittedLines = 0
+}
+
+func (w *logWindow) emit(line string) {
+	if !w.inTail {
+		if w.out.Len()+len(gapMarker(w.omittedLines))+len(line)+1 <= w.firstBytes {
+			w.writeGap()
+			w.out.WriteString(line)
+			w.out.WriteString("\n")
+			return
+		}
+		w.inTail = true
+	}
+
+	e := logEntry{gap: w.omittedLines, line: line}
+	w.omittedLines = 0
+	w.tail = append(w.tail, e)
+	w.tailSize += e.size()
+	for w.tailSize > w.tailBytes && len(w.tail) > 0 {
+		w.dropTail()
+	}
+}
+
+// dropTail omits the oldest line of the tail.
+func (w *logWindow) dropTail() {
+	e := w.tail[0]
+	w.tail = w.tail[1:]
+	w.tailSize -= e.size()
+	w.omittedBytes += len(e.line) + 1
+	if len(w.tail) == 0 {
+		w.omittedLines += e.gap + 1
+		return
+	}
+	next := &w.tail[0]
+	w.tailSize -= next.size()
+	next.gap += e.gap + 1
+	w.tailSize += next.size()
+}
+
+func (w *logWindow) addExcerpt(line string) {
+	isError := w.limits.IsErrorLine != nil && w.limits.IsErrorLine(line)
+	if isError {
+		for _, l := range w.before {
+			w.emit(l)
+		}
+		w.before = w.before[:0]
+		w.after = w.limits.ContextLines
+		w.emit(line)
+		return
+	}
+	if w.after > 0 {
+		w.after--
+		w.emit(line)
+		return
+	}
+
+	if w.limits.ContextLines == 0 {
+		w.omit(line)
+		return
+	}
+	if len(w.before) == w.limits.ContextLines {
+		w.omit(w.before[0])
+		w.before = append(w.before[:0], w.before[1:]...)
+	}
+	w.before = append(w.before, line)
+}
+
+func (w *logWindow) String() string {
+	if !w.excerpts {
+		return strings.Join(w.lines, "\n")
+	}
+
+	for _, l := range w.before {
+		w.omit(l)
+	}
+	w.before = nil
+	for _, e := range w.tail {
+		w.out.WriteString(gapMarker(e.gap))
+		w.out.WriteString(e.line)
+		w.out.WriteString("\n")
+	}
+	w.tail = nil
+	w.writeGap()
+	fmt.Fprintf(&w.out, "[deepgrid: output truncated, %d of %d bytes omitted]", w.omittedBytes, w.totalBytes)
+	return w.out.String()
+}
+
+// scanLines calls fn for every line of r. Lines longer than maxLineBytes
+// are cut, invalid UTF-8 sequences and NUL characters are replaced, so that
+// lines can be stored in the database.
+func scanLines(r io.Reader, maxLineBytes int, fn func(line string)) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var buf []byte
+	cut := false
+	for {
+		chunk, isPrefix, err := br.ReadLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if maxLineBytes == 0 || len(buf)+len(chunk) <= maxLineBytes {
+			buf = append(buf, chunk...)
+		} else {
+			buf = append(buf, chunk[:maxLineBytes-len(buf)]...)
+			cut = true
+		}
+		if isPrefix {
+			continue
+		}
+
+		line := string(buf)
+		if !utf8.ValidString(line) {
+			line = strings.ToValidUTF8(line, "?")
+		}
+		line = strings.ReplaceAll(line, "\x00", "?")
+		if cut {
+			line += " [line truncated]"
+		}
+		fn(line)
+
+		buf = buf[:0]
+		cut = false
+	}
+}
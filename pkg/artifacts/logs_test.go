@@ -0,0 +1,44 @@
+package artifacts
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitBuildLogLimits(t *testing.T) {
+	limits := &LogLimits{
+		MaxBytes:     120,
+		HeadBytes:    10,
+		ContextLines: 1,
+		MaxLineBytes: 12,
+		IsErrorLine: func(line string) bool {
+			return strings.Contains(line, "error")
+		},
+	}
+	testCases := []struct {
+		Input, Output string
+	}{
+		{
+			Input:  "line 1\nline 2\n",
+			Output: "line 1\nline 2",
+		},
+		{
+			Input:  "a very long line\n",
+			Output: "a very long  [line truncated]",
+		},
+		{
+			// The first and the last errors are kept.
+			Input:  "head 1\nline 2\nbefore\nerror 1\nafter\nline 6\nline 7\nerror 2\nline 9\nline 10\nline 11\nline 12\nline 13\nline 14\nline 15\nerror 3\nline 17\n",
+			Output: "head 1\n[... 1 lines omitted ...]\nbefore\nerror 1\nafter\n[... 9 lines omitted ...]\nline 15\nerror 3\nline 17\n[deepgrid: output truncated, 76 of 128 bytes omitted]",
+		},
+	}
+	for _, tc := range testCases {
+		results, err := splitBuildLog("build-log.txt", strings.NewReader(tc.Input), limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Output != tc.Output {
+			t.Errorf("splitBuildLog(%q): got %q, want %q", tc.Input, results[0].Output, tc.Output)
+		}
+	}
+}
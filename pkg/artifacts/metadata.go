@@ -0,0 +1,190 @@
+package artifacts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Metadata values that are longer than maxMetadataValueLength are truncated,
+// keys that are longer than maxMetadataKeyLength are dropped.
+const (
+	maxMetadataKeyLength   = 256
+	maxMetadataValueLength = 1024
+)
+
+// metadataFiles are the files that may contain free-form build metadata.
+// Later files take precedence.
+var metadataFiles = []string{"metadata.json", "artifacts/metadata.json"}
+
+// ProwJobJson is the subset of prowjob.json that is stored as build
+// metadata.
+type ProwJobJson struct {
+	Spec struct {
+		Type    string `json:"type"`
+		Cluster string `json:"cluster"`
+		Refs    *struct {
+			Org     string `json:"org"`
+			Repo    string `json:"repo"`
+			BaseRef string `json:"base_ref"`
+			BaseSHA string `json:"base_sha"`
+			Pulls   []struct {
+				Number int    `json:"number"`
+				Author string `json:"author"`
+				SHA    string `json:"sha"`
+			} `json:"pulls"`
+		} `json:"refs"`
+		ExtraRefs []struct {
+			Org     string `json:"org"`
+			Repo    string `json:"repo"`
+			BaseRef string `json:"base_ref"`
+		} `json:"extra_refs"`
+	} `json:"spec"`
+}
+
+// decodeError is returned by decodeJSON if a file was read, but its content
+// doesn't match the expected type.
+type decodeError struct {
+	name string
+	err  error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("unable to decode %s: %s", e.name, e.err)
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+func (c *Client) decodeJSON(ctx context.Context, build *Build, name string, v interface{}) error {
+	f, err := c.open(ctx, build.Scheme, build.Bucket, build.Prefix+name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(v)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &decodeError{name: build.Prefix + name, err: err}
+		}
+		return fmt.Errorf("unable to decode %s%s: %w", build.Prefix, name, err)
+	}
+	return nil
+}
+
+// flattenMetadata adds the scalar values from v to m. Keys of nested objects
+// are joined with dots, arrays are stored as JSON.
+func flattenMetadata(m map[string]string, prefix string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenMetadata(m, key, value)
+		}
+	case string:
+		m[prefix] = v
+	case float64:
+		m[prefix] = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		m[prefix] = strconv.FormatBool(v)
+	case nil:
+	default:
+		buf, err := json.Marshal(v)
+		if err == nil {
+			m[prefix] = string(buf)
+		}
+	}
+}
+
+// GetBuildMetadata collects key-value metadata about the build from
+// prowjob.json, finished.json and metadata.json files. Missing files are
+// ignored. metadata.json files are free-form, so the ones that can't be
+// decoded are skipped.
+func (c *Client) GetBuildMetadata(ctx context.Context, buildMeta *BuildMeta) (map[string]string, error) {
+	build := buildMeta.Build
+	m := map[string]string{}
+
+	if _, ok := buildMeta.Files[build.Prefix+"prowjob.json"]; ok {
+		var pj ProwJobJson
+		err := c.decodeJSON(ctx, build, "prowjob.json", &pj)
+		if err != nil {
+			return nil, err
+		}
+		m["type"] = pj.Spec.Type
+		m["cluster"] = pj.Spec.Cluster
+		if refs := pj.Spec.Refs; refs != nil {
+			m["repo"] = refs.Org + "/" + refs.Repo
+			m["base_ref"] = refs.BaseRef
+			m["base_sha"] = refs.BaseSHA
+			var pulls, authors []string
+			for _, pull := range refs.Pulls {
+				pulls = append(pulls, strconv.Itoa(pull.Number))
+				authors = append(authors, pull.Author)
+			}
+			if len(pulls) != 0 {
+				m["pulls"] = strings.Join(pulls, ",")
+				m["authors"] = strings.Join(authors, ",")
+			}
+		}
+		var extraRepos []string
+		for _, refs := range pj.Spec.ExtraRefs {
+			extraRepos = append(extraRepos, refs.Org+"/"+refs.Repo+"@"+refs.BaseRef)
+		}
+		if len(extraRepos) != 0 {
+			sort.Strings(extraRepos)
+			m["extra_repos"] = strings.Join(extraRepos, ",")
+		}
+	}
+
+	if _, ok := buildMeta.Files[build.Prefix+"finished.json"]; ok {
+		var finished struct {
+			Revision string                 `json:"revision"`
+			Metadata map[string]interface{} `json:"metadata"`
+		}
+		err := c.decodeJSON(ctx, build, "finished.json", &finished)
+		if err != nil {
+			return nil, err
+		}
+		if finished.Revision != "" {
+			m["revision"] = finished.Revision
+		}
+		flattenMetadata(m, "", finished.Metadata)
+	}
+
+	for _, name := range metadataFiles {
+		if _, ok := buildMeta.Files[build.Prefix+name]; !ok {
+			continue
+		}
+		var metadata map[string]interface{}
+		err := c.decodeJSON(ctx, build, name, &metadata)
+		var de *decodeError
+		if errors.As(err, &de) {
+			klog.Warningf("Skipping metadata of %s: %s", build, err)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		flattenMetadata(m, "", metadata)
+	}
+
+	for key, value := range m {
+		if value == "" || len(key) > maxMetadataKeyLength {
+			delete(m, key)
+		} else if len(value) > maxMetadataValueLength {
+			m[key] = strings.ToValidUTF8(value[:maxMetadataValueLength], "")
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,85 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// ResultParser extracts test results from the content of the file name,
+// which is relative to the build. Parsers of line-based formats bound the
+// outputs of tests by limits.
+type ResultParser func(name string, r io.Reader, limits *LogLimits) ([]*TestResult, error)
+
+// ResultParsers are the known formats of files with test results.
+var ResultParsers = map[string]ResultParser{
+	"junit":  ParseJUnit,
+	"ginkgo": ParseGinkgoReport,
+	"tap":    ParseTAP,
+	"gotest": func(name string, r io.Reader, limits *LogLimits) ([]*TestResult, error) {
+		return ParseGoTestOutput(r, limits)
+	},
+}
+
+type resultFormat struct {
+	name    string
+	pattern *regexp.Regexp
+	parse   ResultParser
+}
+
+// RegisterResultFormat makes GetTestResults parse files whose names
+// (relative to the build and without the .gz suffix) match pattern using the
+// format with the given name. A file is parsed only by the first format that
+// matches it.
+func (c *Client) RegisterResultFormat(name string, pattern string) error {
+	parse, ok := ResultParsers[name]
+	if !ok {
+		return fmt.Errorf("unknown result format %q", name)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("result format %s: %w", name, err)
+	}
+	c.resultFormats = append(c.resultFormats, resultFormat{
+		name:    name,
+		pattern: re,
+		parse:   parse,
+	})
+	return nil
+}
+
+// parseFile parses the object objectName of the build using parse.
+func (c *Client) parseFile(ctx context.Context, buildMeta *BuildMeta, objectName string, parse ResultParser) ([]*TestResult, error) {
+	f, err := c.open(ctx, buildMeta.Build.Scheme, buildMeta.Build.Bucket, objectName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	results, err := parse(uncompressedName(objectName[len(buildMeta.Build.Prefix):]), f, &c.logLimits)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s://%s/%s: %w", buildMeta.Build.Scheme, buildMeta.Build.Bucket, objectName, err)
+	}
+	return results, nil
+}
+
+// GetTestResults extracts test results from the build's files using the
+// registered result formats.
+func (c *Client) GetTestResults(ctx context.Context, buildMeta *BuildMeta) ([]*TestResult, error) {
+	var results []*TestResult
+	for _, objectName := range buildMeta.SortedFiles() {
+		name := uncompressedName(objectName[len(buildMeta.Build.Prefix):])
+		for _, format := range c.resultFormats {
+			if !format.pattern.MatchString(name) {
+				continue
+			}
+			testResults, err := c.parseFile(ctx, buildMeta, objectName, format.parse)
+			if err != nil {
+				return results, err
+			}
+			results = append(results, testResults...)
+			break
+		}
+	}
+	return results, nil
+}
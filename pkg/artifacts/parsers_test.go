@@ -0,0 +1,114 @@
+package artifacts
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResultParsers(t *testing.T) {
+	testCases := []struct {
+		Format string
+		Input  string
+		Output []string
+	}{
+		{
+			Format: "ginkgo",
+			Input: `[{
+  "SuiteDescription": "Operator Suite",
+  "SpecReports": [
+    {
+      "ContainerHierarchyTexts": ["[sig-storage] CSI"],
+      "ContainerHierarchyLabels": [["storage"]],
+      "LeafNodeType": "It",
+      "LeafNodeText": "should mount a volume",
+      "LeafNodeLabels": ["slow"],
+      "State": "failed",
+      "RunTime": 2500000000,
+      "Failure": {
+        "Message": "Timed out waiting for pod",
+        "Location": {"FileName": "test/e2e/csi.go", "LineNumber": 42},
+        "FailureNodeType": "It"
+      },
+      "SpecEvents": [
+        {"SpecEventType": "By", "Message": "creating a pod", "TimelineLocation": {"Order": 1}}
+      ],
+      "ReportEntries": [
+        {"Name": "pod", "Value": {"Representation": "pod-1"}, "TimelineLocation": {"Order": 2}}
+      ]
+    },
+    {
+      "LeafNodeType": "BeforeSuite",
+      "State": "passed",
+      "RunTime": 1000000
+    }
+  ]
+}]`,
+			Output: []string{
+				`Operator Suite: [sig-storage] CSI should mount a volume Failure 2.5s map[failure_location:test/e2e/csi.go:42 labels:storage,slow] "[FAILED] Timed out waiting for pod\nIn [It] at: test/e2e/csi.go:42\nTimeline:\nSTEP: creating a pod\npod: pod-1"`,
+				`Operator Suite: [BeforeSuite] Success 1ms map[] ""`,
+			},
+		},
+		{
+			Format: "junit",
+			Input: `<?xml version="1.0" encoding="utf8"?>
+<testsuite name="e2e">
+  <properties>
+    <property name="owner" value="team-a"/>
+    <property name="platform" value="aws"/>
+  </properties>
+  <testcase name="passes" time="1.5"><system-out>ok</system-out><system-err>warning</system-err></testcase>
+  <testsuite name="upgrade">
+    <testcase name="fails" time="2">
+      <properties><property name="owner" value="team-c"/></properties>
+      <failure>boom</failure>
+      <system-out>ok</system-out>
+    </testcase>
+    <testcase name="errors"><error>panic</error></testcase>
+    <properties><property name="owner" value="team-b"/></properties>
+  </testsuite>
+  <testcase name="skipped"><skipped>not applicable</skipped></testcase>
+</testsuite>`,
+			Output: []string{
+				`e2e: passes Success 1.5s map[owner:team-a platform:aws] ""`,
+				`e2e/upgrade: fails Failure 2s map[owner:team-c platform:aws] "boom"`,
+				`e2e/upgrade: errors Error 0s map[owner:team-b platform:aws] "panic"`,
+				`e2e: skipped Skipped 0s map[owner:team-a platform:aws] "not applicable"`,
+			},
+		},
+		{
+			Format: "tap",
+			Input: `TAP version 13
+1..4
+ok 1 - Input file opened
+not ok 2 - First line of the input valid
+  ---
+  message: 'First line invalid'
+  ...
+ok 3 - Read the rest of the file # SKIP not implemented
+not ok 4 # TODO Not written yet
+`,
+			Output: []string{
+				`results.tap: Input file opened Success 0s map[] "ok 1 - Input file opened"`,
+				`results.tap: First line of the input valid Failure 0s map[] "not ok 2 - First line of the input valid\n  ---\n  message: 'First line invalid'\n  ..."`,
+				`results.tap: Read the rest of the file Skipped 0s map[] "ok 3 - Read the rest of the file # SKIP not implemented"`,
+				`results.tap: test 4 Skipped 0s map[] "not ok 4 # TODO Not written yet"`,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		results, err := ResultParsers[tc.Format]("results."+tc.Format, strings.NewReader(tc.Input), &LogLimits{})
+		if err != nil {
+			t.Errorf("%s: %s", tc.Format, err)
+			continue
+		}
+		var output []string
+		for _, r := range results {
+			output = append(output, fmt.Sprintf("%s: %s %s %s %v %q", r.Suite, r.Test, r.Status, r.Duration, r.Properties, r.Output))
+		}
+		if !reflect.DeepEqual(output, tc.Output) {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.Format, strings.Join(output, "\n"), strings.Join(tc.Output, "\n"))
+		}
+	}
+}
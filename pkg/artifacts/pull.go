@@ -0,0 +1,116 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// linkObject matches the files in pr-logs/directory/<job>/ that point to the
+// actual locations of presubmit builds.
+var linkObject = regexp.MustCompile(`/([0-9]+)\.txt$`)
+
+// pullPrefix matches the locations of presubmit builds. The org_repo part is
+// omitted by Prow for the default repository.
+var pullPrefix = regexp.MustCompile(`(?:^|/)pr-logs/pull/(?:([^/]+)/)?([0-9]+)/[^/]+/[^/]+/$`)
+
+// PullRef describes the pull request that was tested by a presubmit build.
+type PullRef struct {
+	// Repo is org/repo. It may be empty if it cannot be determined.
+	Repo    string
+	Number  int
+	BaseSHA string
+	HeadSHA string
+}
+
+// ResolveBuild finds the location of a build that was discovered through a
+// link file. For other builds it does nothing.
+func (c *Client) ResolveBuild(ctx context.Context, build *Build) error {
+	if build.Link == "" {
+		return nil
+	}
+
+	f, err := c.open(ctx, build.Scheme, build.Bucket, build.Link)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	loc, err := ParseLocation(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return fmt.Errorf("invalid link %s://%s/%s: %w", build.Scheme, build.Bucket, build.Link, err)
+	}
+
+	build.Scheme = loc.Scheme
+	build.Bucket = loc.Bucket
+	build.Prefix = loc.Prefix
+	build.Link = ""
+	return nil
+}
+
+// pullFromPrefix extracts the pull request from the location of a presubmit
+// build. It returns nil for other builds.
+func pullFromPrefix(prefix string) *PullRef {
+	m := pullPrefix.FindStringSubmatch(prefix)
+	if m == nil {
+		return nil
+	}
+	number, err := strconv.Atoi(m[2])
+	if err != nil {
+		return nil
+	}
+	// org_repo is ambiguous if the org has underscores, started.json should
+	// be preferred when it's available.
+	return &PullRef{
+		Repo:   strings.Replace(m[1], "_", "/", 1),
+		Number: number,
+	}
+}
+
+// pullFromStarted extracts the pull request from started.json. The repos
+// field has values like "master:<base sha>,<pull>:<head sha>".
+func pullFromStarted(started StartedJson) *PullRef {
+	if started.Pull == "" {
+		return nil
+	}
+	number, err := strconv.Atoi(started.Pull)
+	if err != nil {
+		return nil
+	}
+	pull := &PullRef{
+		Number: number,
+	}
+	for repo, refs := range started.Repos {
+		parts := strings.Split(refs, ",")
+		var baseSHA, headSHA string
+		found := false
+		for i, part := range parts {
+			ref := strings.SplitN(part, ":", 2)
+			sha := ""
+			if len(ref) == 2 {
+				sha = ref[1]
+			}
+			if i == 0 {
+				baseSHA = sha
+			} else if ref[0] == started.Pull {
+				headSHA = sha
+				found = true
+			}
+		}
+		if found {
+			pull.Repo = repo
+			pull.BaseSHA = baseSHA
+			pull.HeadSHA = headSHA
+			break
+		}
+	}
+	return pull
+}
@@ -0,0 +1,266 @@
+package artifacts
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 hash of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Storage provides access to S3-compatible storages like MinIO. Buckets are
+// addressed using the path style, i.e. <endpoint>/<bucket>/<object>.
+type S3Storage struct {
+	endpoint   *url.URL
+	region     string
+	accessKey  string
+	secretKey  string
+	httpClient *http.Client
+}
+
+var _ Storage = &S3Storage{}
+
+// NewS3Storage returns a storage that sends requests to endpoint. If
+// accessKey is empty, requests are sent anonymously.
+func NewS3Storage(endpoint, region, accessKey, secretKey string) (*S3Storage, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Storage{
+		endpoint:   u,
+		region:     region,
+		accessKey:  accessKey,
+		secretKey:  secretKey,
+		httpClient: http.DefaultClient,
+	}, nil
+}
+
+// NewS3StorageFromEnv creates a storage using the environment variables
+// S3_ENDPOINT, AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func NewS3StorageFromEnv() (*S3Storage, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	return NewS3Storage(endpoint, os.Getenv("AWS_REGION"), os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+}
+
+func (s *S3Storage) get(ctx context.Context, bucket, object string, query url.Values) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket
+	if object != "" {
+		u.Path += "/" + object
+	}
+	// The path should be escaped in the same way as it's signed.
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	// Setting Accept-Encoding explicitly prevents the transport from
+	// decompressing objects with Content-Encoding: gzip, so that they are
+	// stored compressed in the cache.
+	req.Header.Set("Accept-Encoding", "gzip")
+	if s.accessKey != "" {
+		signS3Request(req, s.region, s.accessKey, s.secretKey, time.Now())
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3://%s/%s: %w", bucket, object, ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3://%s/%s: unexpected status %s: %s", bucket, object, resp.Status, body)
+	}
+	return resp, nil
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Storage) list(ctx context.Context, bucket, prefix, delimiter, startAfter string) (dirs []string, files []string, err error) {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if startAfter != "" {
+		query.Set("start-after", startAfter)
+	}
+	for {
+		resp, err := s.get(ctx, bucket, "", query)
+		if err != nil {
+			return nil, nil, err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to decode list of s3://%s/%s: %w", bucket, prefix, err)
+		}
+		for _, c := range result.Contents {
+			files = append(files, c.Key)
+		}
+		for _, p := range result.CommonPrefixes {
+			dirs = append(dirs, p.Prefix)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	return dirs, files, nil
+}
+
+func (s *S3Storage) ListDir(ctx context.Context, bucket, prefix, startOffset string) (dirs []string, files []string, err error) {
+	// start-after is exclusive, but directories have a trailing slash, so a
+	// directory named startOffset is still listed.
+	return s.list(ctx, bucket, prefix, "/", startOffset)
+}
+
+func (s *S3Storage) ListFiles(ctx context.Context, bucket, prefix string) ([]string, error) {
+	_, files, err := s.list(ctx, bucket, prefix, "", "")
+	return files, err
+}
+
+func (s *S3Storage) Open(ctx context.Context, bucket, object string) (io.ReadCloser, error) {
+	resp, err := s.get(ctx, bucket, object, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// s3Escape escapes s according to the rules of AWS Signature Version 4.
+func s3Escape(s string, escapeSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !escapeSlash) {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request adds the Authorization header to req using AWS Signature
+// Version 4. The host header, x-amz-* headers and the range header are
+// signed.
+func signS3Request(req *http.Request, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var headerNames []string
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	query := req.URL.Query()
+	var queryKeys []string
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	var canonicalQuery []string
+	for _, key := range queryKeys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			canonicalQuery = append(canonicalQuery, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(path, false),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
@@ -0,0 +1,90 @@
+package artifacts
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ci-operator logs when it starts and finishes steps, e.g.
+//
+//	INFO[2021-02-15T00:00:00Z] Running step e2e-aws-ipi-install-install.
+//	INFO[2021-02-15T00:40:00Z] Step e2e-aws-ipi-install-install succeeded after 40m0s.
+var (
+	stepStartRe = regexp.MustCompile(`Running step ([^\s]+?)\.?$`)
+	stepEndRe   = regexp.MustCompile(`Step ([^\s]+) (succeeded|failed) after ([0-9.]+[0-9a-zµ.]*)`)
+)
+
+type logStep struct {
+	result *TestResult
+	window *logWindow
+}
+
+// splitBuildLog splits the build log r into ci-operator steps. Every step
+// becomes a result in the suite name with the step's status, duration and the
+// lines that were logged while the step was running. Lines that were logged
+// outside of steps are returned as an Info result named name. The log is
+// processed line by line, and the outputs are bounded by limits.
+//
+// Steps may run in parallel, so a line may belong to several steps.
+func splitBuildLog(name string, r io.Reader, limits *LogLimits) ([]*TestResult, error) {
+	rest := newLogWindow(limits)
+	var steps []*logStep
+	running := map[string]*logStep{}
+
+	err := scanLines(r, limits.MaxLineBytes, func(line string) {
+		if m := stepStartRe.FindStringSubmatch(line); m != nil {
+			step := &logStep{
+				result: &TestResult{
+					Suite:  name,
+					Test:   m[1],
+					Status: TestStatusInfo,
+				},
+				window: newLogWindow(limits),
+			}
+			steps = append(steps, step)
+			running[m[1]] = step
+		}
+
+		if len(running) == 0 {
+			rest.add(line)
+		}
+		for _, step := range running {
+			step.window.add(line)
+		}
+
+		if m := stepEndRe.FindStringSubmatch(line); m != nil {
+			step, ok := running[m[1]]
+			if !ok {
+				return
+			}
+			if m[2] == "succeeded" {
+				step.result.Status = TestStatusSuccess
+			} else {
+				step.result.Status = TestStatusFailure
+			}
+			if d, err := time.ParseDuration(strings.TrimSuffix(m[3], ".")); err == nil {
+				step.result.Duration = d
+				step.result.HasDuration = true
+			}
+			delete(running, m[1])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*TestResult{
+		{
+			Test:   name,
+			Status: TestStatusInfo,
+			Output: rest.String(),
+		},
+	}
+	for _, step := range steps {
+		step.result.Output = step.window.String()
+		results = append(results, step.result)
+	}
+	return results, nil
+}
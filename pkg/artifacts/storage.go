@@ -0,0 +1,63 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Storage provides read-only access to an object storage where build
+// artifacts are kept. Object names are separated by slashes.
+type Storage interface {
+	// ListDir returns the objects and the common prefixes (directories) that
+	// are immediately under prefix. Directories have a trailing slash. If
+	// startOffset is not empty, names that are lexically less than
+	// startOffset may be omitted.
+	ListDir(ctx context.Context, bucket, prefix, startOffset string) (dirs []string, files []string, err error)
+
+	// ListFiles returns all objects that have the given prefix.
+	ListFiles(ctx context.Context, bucket, prefix string) ([]string, error)
+
+	// Open opens the object for reading. If the object doesn't exist, the
+	// returned error wraps ErrNotFound.
+	Open(ctx context.Context, bucket, object string) (io.ReadCloser, error)
+}
+
+// Location is a directory in a storage.
+type Location struct {
+	Scheme string
+	Bucket string
+
+	// Prefix is empty or ends with a slash.
+	Prefix string
+}
+
+// ParseLocation parses URLs like gs://bucket/prefix, s3://bucket/prefix and
+// file:///path. Strings without a scheme are treated as GCS locations.
+func ParseLocation(s string) (Location, error) {
+	if !strings.Contains(s, "://") {
+		s = "gs://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return Location{}, err
+	}
+	if u.Scheme != "file" && u.Host == "" {
+		return Location{}, fmt.Errorf("%s: bucket is not specified", s)
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return Location{
+		Scheme: u.Scheme,
+		Bucket: u.Host,
+		Prefix: prefix,
+	}, nil
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("%s://%s/%s", l.Scheme, l.Bucket, l.Prefix)
+}
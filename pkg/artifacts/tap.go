@@ -0,0 +1,82 @@
+package artifacts
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var (
+	tapTestRe    = regexp.MustCompile(`^(not )?ok\b\s*([0-9]+)?\s*(?:- )?(.*?)\s*(?:#\s*(?i:(skip|todo))\S*\s*(.*))?$`)
+	tapPlanRe    = regexp.MustCompile(`^[0-9]+\.\.[0-9]+`)
+	tapBailOutRe = regexp.MustCompile(`^Bail out!\s*(.*)$`)
+)
+
+// ParseTAP extracts test results from a file in the Test Anything Protocol
+// format. The name of the file is used as the suite. Diagnostics that follow
+// a test line become the test's output, which is bounded by limits.
+func ParseTAP(name string, r io.Reader, limits *LogLimits) ([]*TestResult, error) {
+	var results []*TestResult
+	var current *TestResult
+	output := newLogWindow(limits)
+
+	flush := func() {
+		if current != nil {
+			current.Output = validUTF8(output.String())
+		}
+		output = newLogWindow(limits)
+	}
+
+	err := scanLines(r, limits.MaxLineBytes, func(line string) {
+		if m := tapTestRe.FindStringSubmatch(line); m != nil {
+			flush()
+			test := m[3]
+			if test == "" {
+				test = fmt.Sprintf("test %s", m[2])
+			}
+			var status TestStatus = TestStatusSuccess
+			if m[1] != "" {
+				status = TestStatusFailure
+			}
+			switch strings.ToLower(m[4]) {
+			case "skip":
+				status = TestStatusSkipped
+			case "todo":
+				// Failures of TODO tests are expected.
+				if status == TestStatusFailure {
+					status = TestStatusSkipped
+				}
+			}
+			current = &TestResult{
+				Suite:  name,
+				Test:   test,
+				Status: status,
+			}
+			results = append(results, current)
+			output.add(line)
+			return
+		}
+
+		if m := tapBailOutRe.FindStringSubmatch(line); m != nil {
+			flush()
+			current = &TestResult{
+				Suite:  name,
+				Test:   "Bail out!",
+				Status: TestStatusFailure,
+			}
+			results = append(results, current)
+			output.add(line)
+			return
+		}
+
+		if current != nil && line != "" && !strings.HasPrefix(line, "TAP version") && !tapPlanRe.MatchString(line) {
+			output.add(line)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+	return results, nil
+}
@@ -0,0 +1,192 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+)
+
+// MinHash parameters. Signatures are split into bands of rows; two
+// signatures become candidates if all rows of at least one band are equal.
+// With 16 bands of 4 rows, pairs with the similarity of 0.5 become candidates
+// with the probability of ~0.65, and pairs with 0.7 with ~0.99.
+const (
+	numBands  = 16
+	numRows   = 4
+	numHashes = numBands * numRows
+)
+
+// Lines returns the set of lines of a signature.
+func Lines(signature string) map[string]bool {
+	lines := map[string]bool{}
+	for _, line := range strings.Split(signature, "\n") {
+		if line != "" {
+			lines[line] = true
+		}
+	}
+	return lines
+}
+
+// Jaccard returns the Jaccard similarity of the sets a and b.
+func Jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	common := 0
+	for x := range a {
+		if b[x] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+func hashLine(line string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	return h.Sum64()
+}
+
+// minHash returns the MinHash of the set lines. The hash functions are
+// derived from a single hash using multiply-xorshift mixing with different
+// seeds.
+func minHash(lines map[string]bool) [numHashes]uint64 {
+	var mh [numHashes]uint64
+	for i := range mh {
+		mh[i] = math.MaxUint64
+	}
+	for line := range lines {
+		h := hashLine(line)
+		for i := range mh {
+			x := h ^ (uint64(i+1) * 0x9e3779b97f4a7c15)
+			x ^= x >> 33
+			x *= 0xff51afd7ed558ccd
+			x ^= x >> 33
+			if x < mh[i] {
+				mh[i] = x
+			}
+		}
+	}
+	return mh
+}
+
+type unionFind []int
+
+func newUnionFind(n int) unionFind {
+	uf := make(unionFind, n)
+	for i := range uf {
+		uf[i] = i
+	}
+	return uf
+}
+
+func (uf unionFind) find(i int) int {
+	for uf[i] != i {
+		uf[i] = uf[uf[i]]
+		i = uf[i]
+	}
+	return i
+}
+
+func (uf unionFind) union(i, j int) {
+	i, j = uf.find(i), uf.find(j)
+	if i < j {
+		uf[j] = i
+	} else if j < i {
+		uf[i] = j
+	}
+}
+
+// Signatures groups signatures whose line sets have the Jaccard similarity
+// of at least threshold. Similarity is transitive: if A is similar to B and
+// B is similar to C, then A, B and C are in the same cluster. Candidate pairs
+// are found using MinHash with locality-sensitive hashing and then verified
+// using the exact similarity.
+//
+// Clusters are returned as lists of indexes of signatures, every signature
+// is in exactly one cluster.
+func Signatures(signatures []string, threshold float64) [][]int {
+	sets := make([]map[string]bool, len(signatures))
+	buckets := make([]map[[numRows]uint64][]int, numBands)
+	for b := range buckets {
+		buckets[b] = map[[numRows]uint64][]int{}
+	}
+	for i, sig := range signatures {
+		sets[i] = Lines(sig)
+		mh := minHash(sets[i])
+		for b := range buckets {
+			var key [numRows]uint64
+			copy(key[:], mh[b*numRows:(b+1)*numRows])
+			buckets[b][key] = append(buckets[b][key], i)
+		}
+	}
+
+	uf := newUnionFind(len(signatures))
+	type pair struct{ i, j int }
+	checked := map[pair]bool{}
+	for _, bucket := range buckets {
+		for _, members := range bucket {
+			for x := 0; x < len(members); x++ {
+				for y := x + 1; y < len(members); y++ {
+					p := pair{members[x], members[y]}
+					if checked[p] || uf.find(p.i) == uf.find(p.j) {
+						continue
+					}
+					checked[p] = true
+					if Jaccard(sets[p.i], sets[p.j]) >= threshold {
+						uf.union(p.i, p.j)
+					}
+				}
+			}
+		}
+	}
+
+	clusters := map[int][]int{}
+	var roots []int
+	for i := range signatures {
+		root := uf.find(i)
+		if _, ok := clusters[root]; !ok {
+			roots = append(roots, root)
+		}
+		clusters[root] = append(clusters[root], i)
+	}
+	result := make([][]int, 0, len(roots))
+	for _, root := range roots {
+		result = append(result, clusters[root])
+	}
+	return result
+}
+
+// AssignIDs returns stable IDs for clusters of signatures. A cluster keeps
+// the smallest previous ID of its members. If a previous cluster is split,
+// its ID goes to the biggest part, and the other parts get new IDs starting
+// from nextID. nextID must be bigger than all IDs that were ever assigned, so
+// that IDs of clusters that disappeared are not reused.
+func AssignIDs(clusters [][]string, previous map[string]int64, nextID int64) []int64 {
+	order := make([]int, len(clusters))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return len(clusters[order[a]]) > len(clusters[order[b]])
+	})
+
+	ids := make([]int64, len(clusters))
+	used := map[int64]bool{}
+	for _, i := range order {
+		var id int64
+		for _, sig := range clusters[i] {
+			if prev, ok := previous[sig]; ok && !used[prev] && (id == 0 || prev < id) {
+				id = prev
+			}
+		}
+		if id == 0 {
+			id = nextID
+			nextID++
+		}
+		used[id] = true
+		ids[i] = id
+	}
+	return ids
+}
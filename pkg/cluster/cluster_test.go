@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSignatures(t *testing.T) {
+	signatures := []string{
+		"error: a\nerror: b\nerror: c\nerror: d",
+		"error: x\nerror: y",
+		"error: a\nerror: b\nerror: c\nerror: d\nerror: e",
+		"error: a\nerror: b\nerror: c\nerror: d\nerror: e\nerror: f",
+		"error: z",
+	}
+	clusters := Signatures(signatures, 0.7)
+	want := [][]int{{0, 2, 3}, {1}, {4}}
+	if !reflect.DeepEqual(clusters, want) {
+		t.Errorf("got %v, want %v", clusters, want)
+	}
+}
+
+func TestAssignIDs(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Clusters [][]string
+		Previous map[string]int64
+		NextID   int64
+		IDs      []int64
+	}{
+		{
+			Name:     "new clusters",
+			Clusters: [][]string{{"a"}, {"b", "c"}},
+			Previous: map[string]int64{},
+			NextID:   1,
+			IDs:      []int64{2, 1},
+		},
+		{
+			Name:     "merge keeps the smallest ID",
+			Clusters: [][]string{{"a", "b", "c"}, {"d"}},
+			Previous: map[string]int64{"a": 5, "b": 3, "d": 7},
+			NextID:   8,
+			IDs:      []int64{3, 7},
+		},
+		{
+			Name:     "split keeps the ID for the biggest part",
+			Clusters: [][]string{{"a"}, {"b", "c"}},
+			Previous: map[string]int64{"a": 4, "b": 4, "c": 4},
+			NextID:   9,
+			IDs:      []int64{9, 4},
+		},
+	}
+	for _, tc := range testCases {
+		ids := AssignIDs(tc.Clusters, tc.Previous, tc.NextID)
+		if !reflect.DeepEqual(ids, tc.IDs) {
+			t.Errorf("%s: got %v, want %v", tc.Name, ids, tc.IDs)
+		}
+	}
+}
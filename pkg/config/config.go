@@ -1,21 +1,341 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"regexp"
 
+	"github.com/dmage/deepgrid/pkg/signature"
 	"sigs.k8s.io/yaml"
 )
 
+// DefaultMaxBuilds is the number of the most recent builds that are looked at
+// during a regular indexing pass if max_builds is not set.
+const DefaultMaxBuilds = 5
+
+// Retention describes for how long the indexed data is kept in the database.
+type Retention struct {
+	// Days is the number of days after which builds are garbage collected.
+	// Zero means that builds are kept forever.
+	Days int `json:"days"`
+
+	// KeepCounts makes the garbage collector drop only the outputs, system-out
+	// and system-err of test results, so that old builds are still counted.
+	KeepCounts bool `json:"keep_counts"`
+
+	// Output maps test statuses (info, skipped, error, failure, flake,
+	// success) to the parts of outputs that are stored at indexing time.
+	// Statuses that are not listed keep the full output.
+	Output map[string]OutputRule `json:"output"`
+}
+
+// Values of OutputRule.Keep.
+const (
+	KeepFull   = "full"
+	KeepHead   = "head"
+	KeepErrors = "errors"
+	KeepNone   = "none"
+)
+
+// OutputRule describes which part of the output of a test result is stored.
+// Dropped parts are still available in the build artifacts.
+type OutputRule struct {
+	// Keep is full, head (the first HeadBytes bytes), errors (only error
+	// lines) or none.
+	Keep string `json:"keep"`
+
+	HeadBytes int `json:"head_bytes"`
+}
+
+// testStatuses are the keys of Retention.Output.
+var testStatuses = map[string]bool{
+	"info":    true,
+	"skipped": true,
+	"error":   true,
+	"failure": true,
+	"flake":   true,
+	"success": true,
+}
+
+// OutputRule returns the rule for test results with the given status, e.g.
+// "failure".
+func (r *Retention) OutputRule(status string) OutputRule {
+	if rule, ok := r.Output[status]; ok {
+		return rule
+	}
+	return OutputRule{Keep: KeepFull}
+}
+
+func (r *Retention) validateOutput() error {
+	for status, rule := range r.Output {
+		if !testStatuses[status] {
+			return fmt.Errorf("retention.output: unknown test status %q", status)
+		}
+		switch rule.Keep {
+		case KeepFull, KeepErrors, KeepNone:
+		case KeepHead:
+			if rule.HeadBytes <= 0 {
+				return fmt.Errorf("retention.output.%s: head_bytes must be positive", status)
+			}
+		default:
+			return fmt.Errorf("retention.output.%s: keep must be one of %s, %s, %s or %s", status, KeepFull, KeepHead, KeepErrors, KeepNone)
+		}
+	}
+	return nil
+}
+
+// GoTest describes which files contain the output of go test -v or go test
+// -json that should be turned into test results.
+type GoTest struct {
+	// Files are regular expressions for names of files relative to the
+	// build, e.g. "^build-log.txt$".
+	Files []string `json:"files"`
+
+	files []*regexp.Regexp
+}
+
+// MatchFile returns true if name matches one of the file patterns.
+func (g *GoTest) MatchFile(name string) bool {
+	for _, re := range g.files {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GoTest) compile() error {
+	g.files = nil
+	for _, pattern := range g.Files {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("go_test.files: %w", err)
+		}
+		g.files = append(g.files, re)
+	}
+	return nil
+}
+
+// Default limits for build logs.
+const (
+	DefaultLogMaxBytes     = 1 << 20
+	DefaultLogHeadBytes    = 64 << 10
+	DefaultLogContextLines = 5
+	DefaultLogMaxLineBytes = 64 << 10
+)
+
+// LogLimits bounds the size of the stored output of build logs. Zero values
+// are replaced by the defaults, the default HeadBytes is capped by MaxBytes.
+type LogLimits struct {
+	// MaxBytes is the maximum size of the output of a build log or a
+	// ci-operator step. Bigger outputs are reduced to their first HeadBytes
+	// and the error lines with ContextLines lines around them.
+	MaxBytes     int `json:"max_bytes"`
+	HeadBytes    int `json:"head_bytes"`
+	ContextLines int `json:"context_lines"`
+
+	// MaxLineBytes is the maximum length of a line, longer lines are cut.
+	MaxLineBytes int `json:"max_line_bytes"`
+}
+
+// ResultFormat selects the parser for files with test results.
+type ResultFormat struct {
+	// Format is the name of the parser: junit, ginkgo, tap or gotest.
+	Format string `json:"format"`
+
+	// Pattern is a regular expression for names of files relative to the
+	// build.
+	Pattern string `json:"pattern"`
+}
+
+// DefaultResultFormats are used if result_formats is not set.
+var DefaultResultFormats = []ResultFormat{
+	{Format: "junit", Pattern: `(^|/)junit.*\.xml$`},
+}
+
+// Redaction configures the removal of secrets from test outputs before they
+// are stored. Bearer tokens, AWS keys, pull secrets, private keys and
+// passwords are always redacted.
+type Redaction struct {
+	// Patterns are additional regular expressions for secrets. If a pattern
+	// has a capture group named "secret", only the group is redacted.
+	Patterns []string `json:"patterns"`
+}
+
 type TestGroup struct {
 	GCSPrefix string `json:"gcs_prefix"`
 	Name      string `json:"name"`
+
+	// DaysOfResults is the number of days for which builds are indexed. Zero
+	// means that builds are indexed regardless of their age.
+	DaysOfResults int `json:"days_of_results"`
+
+	// MaxBuilds is the number of the most recent builds that are looked at
+	// during a regular indexing pass.
+	MaxBuilds int `json:"max_builds"`
+
+	Retention *Retention `json:"retention"`
+
+	// GoTest is nil if go test output should not be extracted.
+	GoTest *GoTest `json:"go_test"`
+
+	// Signature overrides the global signature rules for the test group.
+	// Unset fields are taken from the global rules.
+	Signature *signature.Rules `json:"signature"`
 }
 
 type Config struct {
+	// DaysOfResults, MaxBuilds, Retention and GoTest are used for test groups
+	// that don't have their own settings.
+	DaysOfResults int        `json:"days_of_results"`
+	MaxBuilds     int        `json:"max_builds"`
+	Retention     *Retention `json:"retention"`
+	GoTest        *GoTest    `json:"go_test"`
+
+	// ResultFormats are tried in order for every file of a build. A file is
+	// parsed only by the first format whose pattern matches its name.
+	ResultFormats []ResultFormat `json:"result_formats"`
+
+	Logs LogLimits `json:"logs"`
+
+	Redaction Redaction `json:"redaction"`
+
+	// Signature is the rules that are used to generate signatures. Unset
+	// fields are replaced by the built-in rules. If any rules are set, the
+	// version must be set too.
+	Signature *signature.Rules `json:"signature"`
+
 	TestGroups []TestGroup `json:"test_groups"`
 }
 
+func (c *Config) applyDefaults() {
+	if c.MaxBuilds == 0 {
+		c.MaxBuilds = DefaultMaxBuilds
+	}
+	if len(c.ResultFormats) == 0 {
+		c.ResultFormats = DefaultResultFormats
+	}
+	if c.Logs.MaxBytes == 0 {
+		c.Logs.MaxBytes = DefaultLogMaxBytes
+	}
+	if c.Logs.HeadBytes == 0 {
+		c.Logs.HeadBytes = DefaultLogHeadBytes
+		if c.Logs.HeadBytes > c.Logs.MaxBytes {
+			c.Logs.HeadBytes = c.Logs.MaxBytes
+		}
+	}
+	if c.Logs.ContextLines == 0 {
+		c.Logs.ContextLines = DefaultLogContextLines
+	}
+	if c.Logs.MaxLineBytes == 0 {
+		c.Logs.MaxLineBytes = DefaultLogMaxLineBytes
+	}
+	for i := range c.TestGroups {
+		tg := &c.TestGroups[i]
+		if tg.DaysOfResults == 0 {
+			tg.DaysOfResults = c.DaysOfResults
+		}
+		if tg.MaxBuilds == 0 {
+			tg.MaxBuilds = c.MaxBuilds
+		}
+		if tg.Retention == nil {
+			tg.Retention = c.Retention
+		}
+		if tg.Retention == nil {
+			tg.Retention = &Retention{}
+		}
+		if tg.GoTest == nil {
+			tg.GoTest = c.GoTest
+		}
+	}
+}
+
+// applySignatureRules fills unset fields of the signature rules. The global
+// rules inherit the built-in ones, the rules of test groups inherit the
+// global ones.
+func (c *Config) applySignatureRules() error {
+	if c.Signature == nil {
+		c.Signature = &signature.Rules{}
+	}
+	if err := c.Signature.Inherit(signature.DefaultRules()); err != nil {
+		return fmt.Errorf("signature: %w", err)
+	}
+	for i := range c.TestGroups {
+		tg := &c.TestGroups[i]
+		if tg.Signature == nil {
+			tg.Signature = c.Signature
+			continue
+		}
+		if err := tg.Signature.Inherit(c.Signature); err != nil {
+			return fmt.Errorf("test group %s: signature: %w", tg.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.Logs.MaxBytes < 0 || c.Logs.HeadBytes < 0 || c.Logs.ContextLines < 0 || c.Logs.MaxLineBytes < 0 {
+		return fmt.Errorf("logs: limits must not be negative")
+	}
+	if c.Logs.HeadBytes > c.Logs.MaxBytes {
+		return fmt.Errorf("logs.head_bytes must not be greater than logs.max_bytes")
+	}
+	for _, p := range c.Redaction.Patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("redaction.patterns: %w", err)
+		}
+	}
+	if err := c.Signature.Compile(); err != nil {
+		return fmt.Errorf("signature: %w", err)
+	}
+	for _, tg := range c.TestGroups {
+		if tg.Signature != c.Signature {
+			if err := tg.Signature.Compile(); err != nil {
+				return fmt.Errorf("test group %s: signature: %w", tg.Name, err)
+			}
+		}
+		r := tg.Retention
+		if r.Days < 0 {
+			return fmt.Errorf("test group %s: retention.days must not be negative", tg.Name)
+		}
+		// Builds that are deleted completely would be indexed again.
+		if r.Days > 0 && !r.KeepCounts && (tg.DaysOfResults == 0 || tg.DaysOfResults > r.Days) {
+			return fmt.Errorf("test group %s: retention.days must not be less than days_of_results unless retention.keep_counts is set", tg.Name)
+		}
+		if err := r.validateOutput(); err != nil {
+			return fmt.Errorf("test group %s: %w", tg.Name, err)
+		}
+		if tg.GoTest != nil {
+			if err := tg.GoTest.compile(); err != nil {
+				return fmt.Errorf("test group %s: %w", tg.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadSignatureRules loads signature rules from a YAML file in the format of
+// the signature section of the configuration.
+func LoadSignatureRules(path string) (*signature.Rules, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := &signature.Rules{}
+	err = yaml.Unmarshal(buf, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	rules.ApplyDefaults()
+	if err := rules.Compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
 func LoadFromFile(path string) (*Config, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -30,5 +350,13 @@ func LoadFromFile(path string) (*Config, error) {
 
 	config := &Config{}
 	err = yaml.Unmarshal(buf, config)
-	return config, err
+	if err != nil {
+		return nil, err
+	}
+
+	config.applyDefaults()
+	if err := config.applySignatureRules(); err != nil {
+		return nil, err
+	}
+	return config, config.validate()
 }
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		Config    string
+		HeadBytes int
+		Error     bool
+	}{
+		{
+			Config:    "logs:\n  max_bytes: 1000\n",
+			HeadBytes: 1000,
+		},
+		{
+			Config:    "logs:\n  max_bytes: 1000\n  head_bytes: 100\n",
+			HeadBytes: 100,
+		},
+		{
+			Config: "logs:\n  max_bytes: 1000\n  head_bytes: 2000\n",
+			Error:  true,
+		},
+	}
+	for _, tc := range testCases {
+		path := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(tc.Config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadFromFile(path)
+		if tc.Error {
+			if err == nil {
+				t.Errorf("%q: got no error", tc.Config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.Config, err)
+			continue
+		}
+		if cfg.Logs.HeadBytes != tc.HeadBytes {
+			t.Errorf("%q: got head_bytes %d, want %d", tc.Config, cfg.Logs.HeadBytes, tc.HeadBytes)
+		}
+	}
+}
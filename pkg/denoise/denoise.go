@@ -1,22 +1,183 @@
 package denoise
 
-import "regexp"
-
-var (
-	hashRe         = regexp.MustCompile(`[A-Za-z0-9]{64,}`)
-	uuidRe         = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
-	pointerRe      = regexp.MustCompile(`0x[0-9a-f]+`)
-	numberRe       = regexp.MustCompile(`[0-9]+`)
-	randomSuffixRe = regexp.MustCompile(`([._-])[A-Za-z0-9._-]+`)
-	spaceRe        = regexp.MustCompile(`[ \t]+`)
+import (
+	"fmt"
+	"math"
+	"regexp"
 )
 
-func Denoise(line string) string {
-	line = hashRe.ReplaceAllString(line, "HASH")
-	line = uuidRe.ReplaceAllString(line, "UUID")
-	line = pointerRe.ReplaceAllString(line, "0xdeadbeef")
-	line = numberRe.ReplaceAllString(line, "0")
-	line = randomSuffixRe.ReplaceAllString(line, "${1}RANDOM")
-	line = spaceRe.ReplaceAllString(line, " ")
+// Rule replaces matches of Pattern with Replacement, which may refer to
+// capture groups, e.g. ${1}.
+type Rule struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+
+	// MinEntropy makes the rule replace only matches that look random: their
+	// Shannon entropy is at least MinEntropy bits per character, they mix
+	// letters of different case or letters and digits, and they don't
+	// contain word-like runs of lowercase letters.
+	MinEntropy float64 `json:"min_entropy"`
+}
+
+// k8sAlphabet is the alphabet of random suffixes of generated Kubernetes
+// names. It has no vowels and no ambiguous characters.
+const k8sAlphabet = `[bcdfghjklmnpqrstvwxz2456789]`
+
+// k8sSuffix matches 5-character suffixes of generated names that contain a
+// digit. Suffixes without digits can't be told from words like "https".
+const k8sSuffix = `(?:` +
+	`[2456789]` + k8sAlphabet + `{4}|` +
+	k8sAlphabet + `[2456789]` + k8sAlphabet + `{3}|` +
+	k8sAlphabet + `{2}[2456789]` + k8sAlphabet + `{2}|` +
+	k8sAlphabet + `{3}[2456789]` + k8sAlphabet + `|` +
+	k8sAlphabet + `{4}[2456789])`
+
+// DefaultRules are used by Denoise. Every kind of volatile token gets its own
+// placeholder, so that lines that differ only in the values of such tokens
+// become equal, but meaningful tokens like HTTP status codes, versions and
+// host names are preserved.
+var DefaultRules = []Rule{
+	{Name: "timestamp", Pattern: `\b\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?`, Replacement: "TIMESTAMP"},
+	{Name: "syslog-timestamp", Pattern: `\b(?:Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec) +\d{1,2}(?: \d{4})? \d{2}:\d{2}:\d{2}(?:\.\d+)?`, Replacement: "TIMESTAMP"},
+	{Name: "klog-header", Pattern: `\b([IWEF])\d{4} \d{2}:\d{2}:\d{2}\.\d+ +\d+ `, Replacement: "${1} TIMESTAMP THREAD "},
+	{Name: "time", Pattern: `\b\d{2}:\d{2}:\d{2}(?:\.\d+)?\b`, Replacement: "TIMESTAMP"},
+	{Name: "digest", Pattern: `\bsha(256|512):[0-9a-f]{64,128}\b`, Replacement: "sha${1}:DIGEST"},
+	{Name: "uuid", Pattern: `\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`, Replacement: "UUID"},
+	{Name: "ipv6", Pattern: `\b(?:[0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}\b|\b(?:[0-9a-fA-F]{1,4}:){1,6}(?::[0-9a-fA-F]{1,4}){1,6}\b|::1\b`, Replacement: "IPV6"},
+	{Name: "ipv4", Pattern: `\b(?:\d{1,3}\.){3}\d{1,3}\b`, Replacement: "IPV4"},
+	{Name: "file-line", Pattern: `\b([\w./-]+\.(?:go|py|sh|js|ts|java|rb|rs|c|cc|cpp|h|yaml|yml|json)):\d+(?::\d+)?\b`, Replacement: "${1}:LINE"},
+	{Name: "port", Pattern: `(IPV4|IPV6\]|localhost|://[A-Za-z0-9.-]*[A-Za-z]|\b[A-Za-z0-9-]+\.[A-Za-z0-9-]+\.[A-Za-z0-9.-]*[A-Za-z]):\d{1,5}\b`, Replacement: "${1}:PORT"},
+	{Name: "duration", Pattern: `\b\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h)(?:\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h))*\b`, Replacement: "DURATION"},
+	{Name: "k8s-generated-name", Pattern: `-` + k8sAlphabet + `{8,10}-` + k8sAlphabet + `{5}\b|-` + k8sSuffix + `\b`, Replacement: "-GENERATED"},
+	{Name: "pointer", Pattern: `\b0x[0-9a-fA-F]+\b`, Replacement: "POINTER"},
+	{Name: "number", Pattern: `\b\d{5,}\b`, Replacement: "NUMBER"},
+	{Name: "hex-id", Pattern: `\b[0-9a-f]{12,}\b`, Replacement: "HEX"},
+	{Name: "random", Pattern: `\b[A-Za-z0-9]{8,}\b`, Replacement: "RANDOM", MinEntropy: 2.9},
+	{Name: "space", Pattern: `[ \t]+`, Replacement: " "},
+}
+
+type compiledRule struct {
+	name        string
+	re          *regexp.Regexp
+	replacement string
+	minEntropy  float64
+}
+
+// entropy returns the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	n := 0
+	for _, c := range s {
+		counts[c]++
+		n++
+	}
+	h := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(n)
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// maxWordRun is the length of runs of lowercase letters from which a token
+// is considered to contain a word.
+const maxWordRun = 4
+
+// looksRandom reports whether s mixes character classes like random tokens
+// do and has the given entropy.
+func looksRandom(s string, minEntropy float64) bool {
+	var lower, upper, digit bool
+	run := 0
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+			run++
+			if run >= maxWordRun {
+				return false
+			}
+			continue
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+		run = 0
+	}
+	classes := 0
+	for _, ok := range []bool{lower, upper, digit} {
+		if ok {
+			classes++
+		}
+	}
+	return classes >= 2 && entropy(s) >= minEntropy
+}
+
+func (r *compiledRule) apply(line string) string {
+	if r.minEntropy == 0 {
+		return r.re.ReplaceAllString(line, r.replacement)
+	}
+	return r.re.ReplaceAllStringFunc(line, func(match string) string {
+		if !looksRandom(match, r.minEntropy) {
+			return match
+		}
+		return r.re.ReplaceAllString(match, r.replacement)
+	})
+}
+
+// Denoiser replaces volatile parts of lines, like timestamps and random names,
+// so that similar lines become equal.
+type Denoiser struct {
+	rules []compiledRule
+}
+
+// New returns a Denoiser that applies rules in order.
+func New(rules []Rule) (*Denoiser, error) {
+	d := &Denoiser{}
+	for i, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i, r.Name, err)
+		}
+		if r.MinEntropy < 0 {
+			return nil, fmt.Errorf("rule %d (%s): min_entropy must not be negative", i, r.Name)
+		}
+		d.rules = append(d.rules, compiledRule{name: r.Name, re: re, replacement: r.Replacement, minEntropy: r.MinEntropy})
+	}
+	return d, nil
+}
+
+func (d *Denoiser) Denoise(line string) string {
+	for i := range d.rules {
+		line = d.rules[i].apply(line)
+	}
 	return line
 }
+
+// Trace is like Denoise, but also returns the names of the rules that changed
+// the line.
+func (d *Denoiser) Trace(line string) (string, []string) {
+	var fired []string
+	for i := range d.rules {
+		denoised := d.rules[i].apply(line)
+		if denoised != line {
+			fired = append(fired, d.rules[i].name)
+		}
+		line = denoised
+	}
+	return line, fired
+}
+
+var defaultDenoiser = func() *Denoiser {
+	d, err := New(DefaultRules)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}()
+
+// Denoise applies DefaultRules to line.
+func Denoise(line string) string {
+	return defaultDenoiser.Denoise(line)
+}
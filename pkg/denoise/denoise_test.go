@@ -12,11 +12,59 @@ func TestDenoise(t *testing.T) {
 		},
 		{
 			Input:  "Feb 15 00:36:57.939: INFO: Running 'oc --kubeconfig=/tmp/tmp.bjZYPSqRRL observe serviceaccounts --once'",
-			Output: "Feb 0 0:0:0.RANDOM: INFO: Running 'oc -RANDOM=/tmp/tmp.RANDOM observe serviceaccounts -RANDOM'",
+			Output: "TIMESTAMP: INFO: Running 'oc --kubeconfig=/tmp/tmp.RANDOM observe serviceaccounts --once'",
 		},
 		{
 			Input:  "Feb 15 10:31:54.483 W ns/e2e-test-s2i-build-root-f2rcw buildconfig/nodejspass reason/BuildConfigTriggerFailed error triggering Build for BuildConfig e2e-test-s2i-build-root-f2rcw/nodejspass: Internal error occurred: build config e2e-test-s2i-build-root-f2rcw/nodejspass has already instantiated a build for imageid quay.io/openshift/community-e2e-images@sha256:8c2e8b2c36d1775e3d32f598fff3191bd50ef967c6ce7e600a01d609d7e4648e",
-			Output: "Feb 0 0:0:0.RANDOM W ns/e0e-RANDOM buildconfig/nodejspass reason/BuildConfigTriggerFailed error triggering Build for BuildConfig e0e-RANDOM/nodejspass: Internal error occurred: build config e0e-RANDOM/nodejspass has already instantiated a build for imageid quay.RANDOM/openshift/community-RANDOM@sha0:HASH",
+			Output: "TIMESTAMP W ns/e2e-test-s2i-build-root-GENERATED buildconfig/nodejspass reason/BuildConfigTriggerFailed error triggering Build for BuildConfig e2e-test-s2i-build-root-GENERATED/nodejspass: Internal error occurred: build config e2e-test-s2i-build-root-GENERATED/nodejspass has already instantiated a build for imageid quay.io/openshift/community-e2e-images@sha256:DIGEST",
+		},
+		{
+			Input:  "2021-02-15T00:40:00Z Step e2e-aws-ipi-install-install succeeded after 40m0s.",
+			Output: "TIMESTAMP Step e2e-aws-ipi-install-install succeeded after DURATION.",
+		},
+		{
+			Input:  "I0215 10:31:54.483123    1234 controller.go:123] Get https://172.30.0.1:443/api?timeout=32s: dial tcp 172.30.0.1:443: connect: connection refused",
+			Output: "I TIMESTAMP THREAD controller.go:LINE] Get https://IPV4:PORT/api?timeout=DURATION: dial tcp IPV4:PORT: connect: connection refused",
+		},
+		{
+			Input:  "Get \"https://[fd00::1]:6443/healthz\": context deadline exceeded after 1.5s",
+			Output: "Get \"https://[IPV6]:PORT/healthz\": context deadline exceeded after DURATION",
+		},
+		{
+			Input:  "Get \"https://api.ci.example.com:6443/version\": EOF",
+			Output: "Get \"https://api.ci.example.com:PORT/version\": EOF",
+		},
+		{
+			Input:  "Get \"https://registry:5000/v2/\": dial tcp registry.svc.cluster.local:5000: i/o timeout",
+			Output: "Get \"https://registry:PORT/v2/\": dial tcp registry.svc.cluster.local:PORT: i/o timeout",
+		},
+		{
+			Input:  "unable to parse file.txt:12 from git-https-server",
+			Output: "unable to parse file.txt:12 from git-https-server",
+		},
+		{
+			Input:  "pod/router-default-5d8f7c9b6d-x7k2p in namespace openshift-ingress is not ready",
+			Output: "pod/router-default-GENERATED in namespace openshift-ingress is not ready",
+		},
+		{
+			Input:  "the server responded with 503 Service Unavailable for version 4.7.0-0.nightly-2021-02-15-000000",
+			Output: "the server responded with 503 Service Unavailable for version 4.7.0-0.nightly-2021-02-15-NUMBER",
+		},
+		{
+			Input:  "panic: runtime error: invalid memory address or nil pointer dereference [signal SIGSEGV: segv code=0x1 addr=0x0 pc=0x1a2b3c]",
+			Output: "panic: runtime error: invalid memory address or nil pointer dereference [signal SIGSEGV: segv code=POINTER addr=POINTER pc=POINTER]",
+		},
+		{
+			Input:  "container 3f4e5d6c7b8a9f0e1d2c3b4a5f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e exited with code 137",
+			Output: "container HEX exited with code 137",
+		},
+		{
+			Input:  "token aB3xK9mQ2pL7 rejected by KubeAPIServer and DaemonSet openshift-apiserver",
+			Output: "token RANDOM rejected by KubeAPIServer and DaemonSet openshift-apiserver",
+		},
+		{
+			Input:  "build 1361234567890123456 failed in job periodic-ci-openshift-release-master-ocp-4.7-e2e-aws",
+			Output: "build NUMBER failed in job periodic-ci-openshift-release-master-ocp-4.7-e2e-aws",
 		},
 	}
 	for _, tc := range testCases {
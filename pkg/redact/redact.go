@@ -0,0 +1,103 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Placeholder replaces redacted secrets.
+const Placeholder = "[REDACTED]"
+
+// secretGroup is the name of the capture group that holds the secret. If a
+// pattern doesn't have such a group, the whole match is replaced.
+const secretGroup = "secret"
+
+// builtinPatterns detect secrets that commonly leak into CI logs. PEM blocks
+// go first, so that their base64 lines aren't redacted piece by piece.
+var builtinPatterns = []string{
+	// Private keys. Blocks without the END line, e.g. because the middle of
+	// a log was omitted or a line was cut, are redacted up to the end of
+	// their base64 lines.
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----(?:[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----|(?:(?:\s|\\n)+[A-Za-z-]+: [^\n\\]*)*(?:(?:\s|\\n)+[A-Za-z0-9+/=]{16,})*)`,
+	// Authorization: Bearer <token>.
+	`(?i)\bbearer\s+(?P<secret>[A-Za-z0-9\-._~+/]{8,}=*)`,
+	// AWS access key IDs and secret access keys.
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	`(?i)aws_secret_access_key["']?\s*[=:]\s*["']?(?P<secret>[A-Za-z0-9/+=]{40})`,
+	// Base64 credentials of pull secrets and dockerconfigjson payloads.
+	`"auth"\s*:\s*"(?P<secret>[A-Za-z0-9+/]{8,}=*)"`,
+	`\.dockerconfigjson"?\s*[=:]\s*"?(?P<secret>[A-Za-z0-9+/]{16,}=*)`,
+	// Kubeconfig credentials.
+	`\b(?:client-key-data|token)["']?\s*:\s*["']?(?P<secret>[A-Za-z0-9\-._~+/]{16,}=*)`,
+	// password=..., passwd: ...
+	`(?i)passw(?:or)?d["']?\s*[=:]\s*(?P<secret>"[^"\n]*"|'[^'\n]*'|[^\s"',;&]+)`,
+}
+
+type rule struct {
+	re *regexp.Regexp
+
+	// group is the index of the secret group, or 0 for the whole match.
+	group int
+}
+
+// Redactor replaces secrets in test outputs.
+type Redactor struct {
+	rules []rule
+}
+
+// New returns a Redactor that detects the built-in secrets and matches of
+// patterns. If a pattern has a capture group named "secret", only the group
+// is replaced.
+func New(patterns []string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, p := range builtinPatterns {
+		r.add(regexp.MustCompile(p))
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %q: %w", p, err)
+		}
+		r.add(re)
+	}
+	return r, nil
+}
+
+func (r *Redactor) add(re *regexp.Regexp) {
+	group := 0
+	if i := re.SubexpIndex(secretGroup); i > 0 {
+		group = i
+	}
+	r.rules = append(r.rules, rule{re: re, group: group})
+}
+
+// Redact returns s with secrets replaced by Placeholder and the number of
+// replaced secrets.
+func (r *Redactor) Redact(s string) (string, int) {
+	count := 0
+	for _, rule := range r.rules {
+		matches := rule.re.FindAllStringSubmatchIndex(s, -1)
+		if matches == nil {
+			continue
+		}
+
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			start, end := m[2*rule.group], m[2*rule.group+1]
+			// Secrets that are already redacted by previous rules are
+			// skipped.
+			if start < 0 || end == start || s[start:end] == Placeholder {
+				continue
+			}
+			b.WriteString(s[last:start])
+			b.WriteString(Placeholder)
+			last = end
+			count++
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+	return s, count
+}
@@ -0,0 +1,131 @@
+package signature
+
+import (
+	"regexp"
+	"strings"
+)
+
+// maxFrames is the number of stack frames that are included in fingerprints
+// of panics.
+const maxFrames = 3
+
+var (
+	// Ginkgo failure locations, e.g.
+	//
+	//	fail [github.com/openshift/origin/test/extended/builds/s2i_root.go:123]: Unexpected error:
+	//	In [It] at: /go/src/github.com/openshift/origin/test/e2e/csi.go:42
+	//	/go/src/github.com/openshift/origin/test/extended/util/client.go:123
+	ginkgoLocationRes = []*regexp.Regexp{
+		regexp.MustCompile(`\bfail \[([^\]\s]+\.go:\d+)\]`),
+		regexp.MustCompile(`\bIn \[[^\]]+\] at: (\S+\.go:\d+)`),
+		regexp.MustCompile(`(?m)^\s*(/\S+\.go:\d+)\s*$`),
+	}
+
+	panicRe     = regexp.MustCompile(`(?m)^\s*panic: `)
+	goroutineRe = regexp.MustCompile(`^goroutine \d+ \[[^\]]+\]:$`)
+	frameFileRe = regexp.MustCompile(`^\t\S+\.go:\d+`)
+
+	gopathRe        = regexp.MustCompile(`^.*/(?:src|vendor|pkg/mod)/`)
+	moduleVersionRe = regexp.MustCompile(`@v[^/]+`)
+)
+
+// skippedFramePrefixes are the prefixes of functions that don't identify
+// the code that panicked.
+var skippedFramePrefixes = []string{
+	"runtime.",
+	"testing.",
+	"github.com/onsi/ginkgo",
+	"github.com/onsi/gomega",
+}
+
+// normalizeLocation removes GOPATH, vendor and module cache directories and
+// module versions from the file path location, so that locations from
+// different build environments are equal.
+func normalizeLocation(location string) string {
+	location = gopathRe.ReplaceAllString(location, "")
+	return moduleVersionRe.ReplaceAllString(location, "")
+}
+
+// frameFunction returns the name of the function of a stack frame line
+// without its arguments, e.g. github.com/foo/bar.(*T).Method for
+// github.com/foo/bar.(*T).Method(0xc000010000, 0x1).
+func frameFunction(line string) string {
+	if i := strings.LastIndexByte(line, '('); i > 0 && strings.HasSuffix(line, ")") {
+		return line[:i]
+	}
+	return line
+}
+
+func skipFrame(function string) bool {
+	for _, prefix := range skippedFramePrefixes {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// panicFingerprint returns the top frames of the first goroutine that
+// panicked in output. Frames that recovered the panic and frames of the
+// runtime and test frameworks are skipped.
+func panicFingerprint(output string) string {
+	loc := panicRe.FindStringIndex(output)
+	if loc == nil {
+		return ""
+	}
+
+	lines := strings.Split(output[loc[1]:], "\n")
+	start := -1
+	for i, line := range lines {
+		if goroutineRe.MatchString(line) {
+			start = i + 1
+			break
+		}
+	}
+	if start == -1 {
+		return ""
+	}
+
+	var functions []string
+	for i := start; i+1 < len(lines); i += 2 {
+		line := lines[i]
+		if line == "" || strings.HasPrefix(line, "created by ") || !frameFileRe.MatchString(lines[i+1]) {
+			break
+		}
+		function := frameFunction(line)
+		if function == "panic" {
+			// The frames above panic are deferred functions that handled
+			// the panic.
+			functions = functions[:0]
+			continue
+		}
+		functions = append(functions, function)
+	}
+
+	var frames []string
+	for _, function := range functions {
+		if skipFrame(function) {
+			continue
+		}
+		frames = append(frames, function)
+		if len(frames) == maxFrames {
+			break
+		}
+	}
+	if len(frames) == 0 {
+		return ""
+	}
+	return "panic: " + strings.Join(frames, " <- ")
+}
+
+// Fingerprint returns the most stable identity of a failure: the normalized
+// Ginkgo failure location, or the top stack frames of a Go panic. It returns
+// an empty string if output has neither.
+func Fingerprint(output string) string {
+	for _, re := range ginkgoLocationRes {
+		if m := re.FindStringSubmatch(output); m != nil {
+			return normalizeLocation(m[1])
+		}
+	}
+	return panicFingerprint(output)
+}
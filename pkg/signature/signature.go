@@ -0,0 +1,205 @@
+package signature
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dmage/deepgrid/pkg/denoise"
+)
+
+// DefaultVersion is the version of DefaultRules.
+const DefaultVersion = 4
+
+// Pattern is a named regular expression.
+type Pattern struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// Default patterns for error lines.
+var (
+	DefaultErrorLines = []Pattern{
+		{Name: "error", Pattern: `(?i)(?:error|fail|unable|illegal|violation|forbidden|cannot|can't|should not|did not|didn't|isn't|is not|aren't|are not|timed?.?out|unavailable)`},
+	}
+	DefaultExcludeLines = []Pattern{
+		{Name: "event", Pattern: `(?i)(?:INFO: .* event for)`},
+	}
+)
+
+// Rules describe how signatures are generated from test outputs. A
+// signature is the sorted set of denoised error lines of an output.
+type Rules struct {
+	// Version identifies the rules. It should be changed whenever the rules
+	// change, so that the signatures and fingerprints of existing test
+	// results can be updated by the resignature command. It must be set if
+	// any rules are overridden, see Inherit.
+	Version int `json:"version"`
+
+	// Denoise rules are applied to every line in order.
+	Denoise []denoise.Rule `json:"denoise"`
+
+	// ErrorLines match lines that may be a part of a signature unless they
+	// also match ExcludeLines.
+	ErrorLines   []Pattern `json:"error_lines"`
+	ExcludeLines []Pattern `json:"exclude_lines"`
+
+	denoiser     *denoise.Denoiser
+	errorLines   []namedRegexp
+	excludeLines []namedRegexp
+}
+
+type namedRegexp struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// DefaultRules returns the built-in rules.
+func DefaultRules() *Rules {
+	r := &Rules{}
+	r.ApplyDefaults()
+	return r
+}
+
+// ApplyDefaults replaces unset fields with the built-in values.
+func (r *Rules) ApplyDefaults() {
+	if r.Version == 0 {
+		r.Version = DefaultVersion
+	}
+	if len(r.Denoise) == 0 {
+		r.Denoise = denoise.DefaultRules
+	}
+	if len(r.ErrorLines) == 0 {
+		r.ErrorLines = DefaultErrorLines
+	}
+	if len(r.ExcludeLines) == 0 {
+		r.ExcludeLines = DefaultExcludeLines
+	}
+}
+
+// Inherit replaces unset fields with the ones of parent. Rules that override
+// any rules of parent must have their own version, otherwise the resignature
+// command couldn't tell their signatures from the ones of parent.
+func (r *Rules) Inherit(parent *Rules) error {
+	overrides := len(r.Denoise) != 0 || len(r.ErrorLines) != 0 || len(r.ExcludeLines) != 0
+	if overrides && (r.Version == 0 || r.Version == parent.Version) {
+		return fmt.Errorf("overridden rules must have a version other than %d", parent.Version)
+	}
+	if r.Version == 0 {
+		r.Version = parent.Version
+	}
+	if len(r.Denoise) == 0 {
+		r.Denoise = parent.Denoise
+	}
+	if len(r.ErrorLines) == 0 {
+		r.ErrorLines = parent.ErrorLines
+	}
+	if len(r.ExcludeLines) == 0 {
+		r.ExcludeLines = parent.ExcludeLines
+	}
+	return nil
+}
+
+func compilePatterns(field string, patterns []Pattern) ([]namedRegexp, error) {
+	var res []namedRegexp
+	for i, p := range patterns {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d] (%s): %w", field, i, p.Name, err)
+		}
+		res = append(res, namedRegexp{name: p.Name, re: re})
+	}
+	return res, nil
+}
+
+// Compile validates the rules and prepares them for use. It should be
+// called before IsErrorLine and Generate.
+func (r *Rules) Compile() error {
+	denoiser, err := denoise.New(r.Denoise)
+	if err != nil {
+		return fmt.Errorf("denoise: %w", err)
+	}
+	errorLines, err := compilePatterns("error_lines", r.ErrorLines)
+	if err != nil {
+		return err
+	}
+	excludeLines, err := compilePatterns("exclude_lines", r.ExcludeLines)
+	if err != nil {
+		return err
+	}
+	r.denoiser, r.errorLines, r.excludeLines = denoiser, errorLines, excludeLines
+	return nil
+}
+
+// firstMatch returns the name of the first pattern that matches line and
+// whether any pattern matches.
+func firstMatch(res []namedRegexp, line string) (string, bool) {
+	for _, r := range res {
+		if r.re.MatchString(line) {
+			return r.name, true
+		}
+	}
+	return "", false
+}
+
+// IsErrorLine reports whether line may be a part of a signature.
+func (r *Rules) IsErrorLine(line string) bool {
+	if _, ok := firstMatch(r.errorLines, line); !ok {
+		return false
+	}
+	_, excluded := firstMatch(r.excludeLines, line)
+	return !excluded
+}
+
+// LineTrace describes how Generate processes a line.
+type LineTrace struct {
+	Line     string
+	Denoised string
+
+	// Denoise is the names of the denoise rules that changed the line.
+	Denoise []string
+
+	// ErrorLine and ExcludeLine are the names of the first error and
+	// exclude patterns that match the denoised line.
+	ErrorLine   string
+	ExcludeLine string
+
+	// IsErrorLine is true if the denoised line is a part of the signature.
+	IsErrorLine bool
+}
+
+// Trace returns the traces of the lines of output.
+func (r *Rules) Trace(output string) []LineTrace {
+	var traces []LineTrace
+	for _, line := range strings.Split(output, "\n") {
+		t := LineTrace{Line: line}
+		t.Denoised, t.Denoise = r.denoiser.Trace(line)
+		var isError, excluded bool
+		t.ErrorLine, isError = firstMatch(r.errorLines, t.Denoised)
+		if isError {
+			t.ExcludeLine, excluded = firstMatch(r.excludeLines, t.Denoised)
+		}
+		t.IsErrorLine = isError && !excluded
+		traces = append(traces, t)
+	}
+	return traces
+}
+
+// Generate returns the signature of output.
+func (r *Rules) Generate(output string) string {
+	errorLines := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		line = r.denoiser.Denoise(line)
+		if r.IsErrorLine(line) {
+			errorLines[line] = true
+		}
+	}
+
+	var lines []string
+	for line := range errorLines {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,132 @@
+package signature
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dmage/deepgrid/pkg/denoise"
+)
+
+func TestGenerate(t *testing.T) {
+	testCases := []struct {
+		Rules  *Rules
+		Input  string
+		Output string
+	}{
+		{
+			Rules:  &Rules{},
+			Input:  "Feb 15 00:36:57.939: INFO: Running pod-x7k2p\nerror: pod-x7k2p failed after 1.5s\nerror: pod-b9z4q failed after 2s\nFeb 15: INFO: Warning event for pod-x7k2p",
+			Output: "error: pod-GENERATED failed after DURATION",
+		},
+		{
+			Rules: &Rules{
+				Denoise:      []denoise.Rule{{Name: "pod", Pattern: `pod-[0-9]+`, Replacement: "POD"}},
+				ErrorLines:   []Pattern{{Name: "panic", Pattern: `panic:`}},
+				ExcludeLines: []Pattern{{Name: "recovered", Pattern: `recovered`}},
+			},
+			Input:  "error: pod-2 failed\npanic: pod-1 crashed\npanic: recovered in pod-7",
+			Output: "panic: POD crashed",
+		},
+	}
+	for _, tc := range testCases {
+		tc.Rules.ApplyDefaults()
+		if err := tc.Rules.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		output := tc.Rules.Generate(tc.Input)
+		if output != tc.Output {
+			t.Errorf("Generate(%q): got %q, want %q", tc.Input, output, tc.Output)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	rules := &Rules{
+		ErrorLines: []Pattern{{Name: "broken", Pattern: `(`}},
+	}
+	rules.ApplyDefaults()
+	err := rules.Compile()
+	if err == nil || !strings.HasPrefix(err.Error(), "error_lines[0] (broken): ") {
+		t.Errorf("got %v, want an error for error_lines[0]", err)
+	}
+}
+
+func TestInherit(t *testing.T) {
+	parent := &Rules{
+		Version:    10,
+		ErrorLines: []Pattern{{Name: "panic", Pattern: `panic`}},
+	}
+	parent.ApplyDefaults()
+
+	rules := &Rules{
+		Version:      11,
+		ExcludeLines: []Pattern{{Name: "recovered", Pattern: `recovered`}},
+	}
+	if err := rules.Inherit(parent); err != nil {
+		t.Fatal(err)
+	}
+	if rules.Version != 11 || !reflect.DeepEqual(rules.ErrorLines, parent.ErrorLines) {
+		t.Errorf("got %+v, want version 11 and the error lines of the parent", rules)
+	}
+
+	for _, version := range []int{0, 10} {
+		rules := &Rules{
+			Version:      version,
+			ExcludeLines: []Pattern{{Name: "recovered", Pattern: `recovered`}},
+		}
+		if err := rules.Inherit(parent); err == nil {
+			t.Errorf("version %d: got no error for overridden rules", version)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	testCases := []struct {
+		Input  string
+		Output string
+	}{
+		{
+			Input:  "fail [github.com/openshift/origin/test/extended/builds/s2i_root.go:123]: Unexpected error:\n    timed out",
+			Output: "github.com/openshift/origin/test/extended/builds/s2i_root.go:123",
+		},
+		{
+			Input:  "[FAILED] Timed out waiting for pod\nIn [It] at: /go/src/github.com/openshift/origin/vendor/k8s.io/kubernetes/test/e2e/storage/csi.go:42",
+			Output: "k8s.io/kubernetes/test/e2e/storage/csi.go:42",
+		},
+		{
+			Input:  "/home/prow/go/pkg/mod/github.com/openshift/origin@v0.0.0-20210215/test/extended/util/client.go:77\nExpected success, but got an error",
+			Output: "github.com/openshift/origin/test/extended/util/client.go:77",
+		},
+		{
+			Input: `panic: runtime error: invalid memory address or nil pointer dereference [recovered]
+	panic: runtime error: invalid memory address or nil pointer dereference
+[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x1a2b3c]
+
+goroutine 42 [running]:
+github.com/onsi/ginkgo/internal/leafnodes.(*runner).runSync.func1(0xc000123456)
+	/go/src/github.com/onsi/ginkgo/internal/leafnodes/runner.go:113 +0x1d
+panic(0x1234560, 0x2345670)
+	/usr/local/go/src/runtime/panic.go:969 +0x1b9
+github.com/openshift/origin/test/extended/util.(*CLI).Run(0x0, 0x3456789, 0x3)
+	/go/src/github.com/openshift/origin/test/extended/util/client.go:512 +0x42
+github.com/openshift/origin/test/extended/builds.glob..func1.2()
+	/go/src/github.com/openshift/origin/test/extended/builds/s2i_root.go:58 +0x1c5
+github.com/onsi/ginkgo/internal/leafnodes.(*runner).runSync(0xc000234567)
+	/go/src/github.com/onsi/ginkgo/internal/leafnodes/runner.go:110 +0x9c
+created by testing.(*T).Run
+	/usr/local/go/src/testing/testing.go:1238 +0x2b3`,
+			Output: "panic: github.com/openshift/origin/test/extended/util.(*CLI).Run <- github.com/openshift/origin/test/extended/builds.glob..func1.2",
+		},
+		{
+			Input:  "error: unable to connect to the server",
+			Output: "",
+		},
+	}
+	for _, tc := range testCases {
+		output := Fingerprint(tc.Input)
+		if output != tc.Output {
+			t.Errorf("Fingerprint(%q): got %q, want %q", tc.Input, output, tc.Output)
+		}
+	}
+}
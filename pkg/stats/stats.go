@@ -0,0 +1,97 @@
+// Package stats provides the statistics that are used to compare test
+// durations.
+package stats
+
+import (
+	"math"
+	"sort"
+)
+
+// Percentile returns the p-th percentile (0 <= p <= 1) of values using
+// linear interpolation between the closest ranks, like percentile_cont in
+// PostgreSQL. It returns NaN if values is empty.
+func Percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	pos := p * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+	if lower == upper {
+		return sorted[lower]
+	}
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(pos-float64(lower))
+}
+
+// MannWhitneyU performs the two-sided Mann-Whitney U test on the samples a
+// and b. It returns the z-score of a relative to b (positive if values in a
+// tend to be bigger) and the p-value, using the normal approximation with the
+// correction for ties. The approximation is reasonable when both samples have
+// at least 10 values.
+func MannWhitneyU(a, b []float64) (z float64, p float64) {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 0, 1
+	}
+
+	type value struct {
+		v       float64
+		fromA   bool
+		ranking float64
+	}
+	values := make([]value, 0, len(a)+len(b))
+	for _, v := range a {
+		values = append(values, value{v: v, fromA: true})
+	}
+	for _, v := range b {
+		values = append(values, value{v: v})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].v < values[j].v
+	})
+
+	// Tied values get the average of their ranks.
+	var tieCorrection float64
+	for i := 0; i < len(values); {
+		j := i + 1
+		for j < len(values) && values[j].v == values[i].v {
+			j++
+		}
+		ranking := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			values[k].ranking = ranking
+		}
+		t := float64(j - i)
+		tieCorrection += t*t*t - t
+		i = j
+	}
+
+	var rankSum float64
+	for _, v := range values {
+		if v.fromA {
+			rankSum += v.ranking
+		}
+	}
+
+	n := n1 + n2
+	u := rankSum - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - tieCorrection/(n*(n-1))))
+	if sigma == 0 {
+		return 0, 1
+	}
+
+	// Continuity correction.
+	diff := u - mean
+	if diff > 0 {
+		diff = math.Max(diff-0.5, 0)
+	} else {
+		diff = math.Min(diff+0.5, 0)
+	}
+	z = diff / sigma
+	p = math.Erfc(math.Abs(z) / math.Sqrt2)
+	return z, p
+}
@@ -0,0 +1,83 @@
+package stats
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPercentile(t *testing.T) {
+	testCases := []struct {
+		Values []float64
+		P      float64
+		Output float64
+	}{
+		{
+			Values: []float64{3, 1, 2},
+			P:      0.5,
+			Output: 2,
+		},
+		{
+			Values: []float64{1, 2, 3, 4},
+			P:      0.5,
+			Output: 2.5,
+		},
+		{
+			Values: []float64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100},
+			P:      0.9,
+			Output: 91,
+		},
+		{
+			Values: []float64{5},
+			P:      0.99,
+			Output: 5,
+		},
+	}
+	for _, tc := range testCases {
+		output := Percentile(tc.Values, tc.P)
+		if math.Abs(output-tc.Output) > 1e-9 {
+			t.Errorf("Percentile(%v, %v): got %v, want %v", tc.Values, tc.P, output, tc.Output)
+		}
+	}
+
+	if output := Percentile(nil, 0.5); !math.IsNaN(output) {
+		t.Errorf("Percentile(nil, 0.5): got %v, want NaN", output)
+	}
+}
+
+func TestMannWhitneyU(t *testing.T) {
+	testCases := []struct {
+		A, B []float64
+		Z, P float64
+	}{
+		{
+			A: []float64{1, 2, 3, 4, 5},
+			B: []float64{1, 2, 3, 4, 5},
+			Z: 0,
+			P: 1,
+		},
+		{
+			A: []float64{11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			B: []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			Z: 3.741848282791349,
+			P: 0.000182671791,
+		},
+		{
+			A: []float64{1, 1, 1},
+			B: []float64{1, 1},
+			Z: 0,
+			P: 1,
+		},
+		{
+			A: nil,
+			B: []float64{1, 2},
+			Z: 0,
+			P: 1,
+		},
+	}
+	for _, tc := range testCases {
+		z, p := MannWhitneyU(tc.A, tc.B)
+		if math.Abs(z-tc.Z) > 1e-6 || math.Abs(p-tc.P) > 1e-6 {
+			t.Errorf("MannWhitneyU(%v, %v): got z=%v p=%v, want z=%v p=%v", tc.A, tc.B, z, p, tc.Z, tc.P)
+		}
+	}
+}